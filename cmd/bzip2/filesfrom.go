@@ -0,0 +1,153 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// processList processes the files named in listPath ("-" for stdin), one
+// per line, on -cores workers. Names are dispatched as they are read, so a
+// slow producer such as find overlaps with the compression instead of
+// being waited for. Output names are chosen by the reader in list order,
+// so --flatten resolves collisions the same way however the workers are
+// scheduled. If reading the list fails, files already dispatched still
+// finish before the error is returned.
+func processList(listPath string) error {
+	list := os.Stdin
+	if listPath != "-" {
+		var err error
+		list, err = os.Open(listPath)
+		if err != nil {
+			return err
+		}
+	}
+	defer list.Close()
+
+	var (
+		mu         sync.Mutex
+		queued     int
+		finished   int
+		listed     bool // queued is final
+		totalBytes int64
+	)
+	// label is the progress name; the file count is "?" until the list
+	// is closed. mu must be held.
+	label := func() string {
+		if listed {
+			return fmt.Sprintf("%d/%d files", finished, queued)
+		}
+		return fmt.Sprintf("%d/? files", finished)
+	}
+
+	var prog *progress
+	if *showProgress == true {
+		prog = newProgress(label(), -1)
+	}
+	if *memStats == true {
+		sampler = startMemSampler()
+	}
+
+	// a job is a listed file and its output name, or the error choosing it
+	type job struct {
+		name, outFilePath string
+		err               error
+	}
+	jobs := make(chan job, 64)
+	var listErr error
+	go func() {
+		defer close(jobs)
+		sc := bufio.NewScanner(list)
+		for sc.Scan() {
+			name := sc.Text()
+			if name == "" {
+				continue
+			}
+			mu.Lock()
+			queued++
+			if fi, err := os.Stat(name); err == nil {
+				totalBytes += fi.Size()
+			}
+			mu.Unlock()
+			outFilePath, err := outputPath(name)
+			jobs <- job{name, outFilePath, err}
+		}
+		listErr = sc.Err()
+
+		mu.Lock()
+		listed = true
+		if prog != nil {
+			prog.set(label(), totalBytes)
+		}
+		mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < *cores; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				name, err := j.name, j.err
+				var res result
+				if err == nil {
+					var fm *fileMeter
+					var meter io.Writer
+					if prog != nil {
+						total := int64(-1)
+						if fi, err := os.Stat(name); err == nil {
+							total = fi.Size()
+						}
+						fm = prog.startFile(name, total)
+						meter = fm
+					}
+					res, err = process(name, j.outFilePath, meter)
+					if fm != nil {
+						prog.endFile(fm)
+					}
+				}
+				if err != nil {
+					eprintf("%s: %s: %v\n", os.Args[0], name, err)
+				}
+
+				run.add(res, err)
+				mu.Lock()
+				finished++
+				if prog != nil {
+					total := int64(-1)
+					if listed {
+						total = totalBytes
+					}
+					prog.set(label(), total)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if prog != nil {
+		prog.Close()
+	}
+
+	if *verbose == true {
+		eprintf("  %d files, %d failed, %d in, %d out.\n", finished, run.failed, run.nIn, run.nOut)
+	}
+	if sampler != nil {
+		reportMem("total", sampler.Stop())
+	}
+	if listErr != nil {
+		return fmt.Errorf("error reading file list %s: %v", listPath, listErr)
+	}
+	if run.failed > 0 && run.failed == run.incomplete {
+		return incompleteError(fmt.Sprintf("%d of %d files incomplete", run.failed, finished))
+	}
+	if run.failed > 0 {
+		return fmt.Errorf("%d of %d files failed", run.failed, finished)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Files are processed as their names arrive, before the list is closed.
+func TestFilesFromStreams(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "a"), "first")
+	writeFile(t, filepath.Join(dir, "b"), "second")
+
+	cmd := command(t, dir, "bzip2", "-k", "-files-from=-")
+	list, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	io.WriteString(list, "a\n")
+
+	// the output may be seen half written; that fails to decompress
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if got, _ := decompressFile(filepath.Join(dir, "a.bz2")); got == "first" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first file not processed while the list is open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	io.WriteString(list, "b\n")
+	list.Close()
+	if err = cmd.Wait(); err != nil {
+		t.Fatalf("%v\n%s", err, &stderr)
+	}
+	if got := readBz2(t, filepath.Join(dir, "b.bz2")); got != "second" {
+		t.Errorf("b.bz2 holds %q", got)
+	}
+}
+
+// A list that breaks partway fails the run with a clear message, after the
+// files already dispatched have been processed.
+func TestFilesFromReadError(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	data := strings.Repeat("data", 100000)
+	writeFile(t, filepath.Join(dir, "a"), data)
+	// a line longer than the scanner accepts makes reading the list fail
+	writeFile(t, filepath.Join(dir, "list"), "a\n"+strings.Repeat("x", 100000)+"\nb\n")
+	writeFile(t, filepath.Join(dir, "b"), "never")
+
+	cmd := command(t, dir, "bzip2", "-k", "-files-from=list")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatal("run succeeded with a broken list")
+	}
+	if !strings.Contains(stderr.String(), "error reading file list list") {
+		t.Errorf("no list error in:\n%s", &stderr)
+	}
+	if got := readBz2(t, filepath.Join(dir, "a.bz2")); got != data {
+		t.Error("dispatched file not completed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.bz2")); !os.IsNotExist(err) {
+		t.Errorf("file after the error processed: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+var (
+	// interrupted is closed when the run is interrupted by a signal.
+	interrupted = make(chan struct{})
+	// rewriting is read-locked while a file is rewritten in place, from
+	// before it is truncated until it is renamed or restored. The signal
+	// handler takes the write lock, so the process never exits with a
+	// file half written.
+	rewriting sync.RWMutex
+
+	errInterrupted = errors.New("interrupted")
+)
+
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// interruptible fails writes once the run is interrupted.
+type interruptible struct{ io.Writer }
+
+func (w interruptible) Write(p []byte) (int, error) {
+	if isInterrupted() {
+		return 0, errInterrupted
+	}
+	return w.Writer.Write(p)
+}
+
+// spool holds a copy of the original content while --in-place rewrites
+// the file: in memory, or in a temporary file under --tempdir.
+type spool interface {
+	io.Writer
+	// reader returns the spooled content from the start.
+	reader() (io.Reader, error)
+	// discard releases the copy.
+	discard()
+}
+
+type memSpool struct{ bytes.Buffer }
+
+func (m *memSpool) reader() (io.Reader, error) { return bytes.NewReader(m.Bytes()), nil }
+func (m *memSpool) discard()                   { m.Reset() }
+
+type fileSpool struct{ *os.File }
+
+func (f fileSpool) reader() (io.Reader, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	return f.File, err
+}
+
+func (f fileSpool) discard() {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func newSpool() (spool, error) {
+	if *tempDir == "" {
+		return &memSpool{}, nil
+	}
+	f, err := ioutil.TempFile(*tempDir, "bzip2-inplace-")
+	if err != nil {
+		return nil, err
+	}
+	return fileSpool{f}, nil
+}
+
+// convertInPlace converts inFilePath within its own inode and then gives
+// it the name outFilePath. The original content is first copied to a
+// spool; the file is then truncated and the converted data is written
+// back into it from the spool. Any failure until the rename is done,
+// the rename included, truncates the file again and copies the original
+// content back, and so does an interrupt.
+//
+// The data is always kept in the same inode. The name change is made
+// with a hard link followed by removing the old name, which keeps the
+// inode as well; where hard links aren't supported it falls back to
+// os.Rename, which keeps the inode on POSIX systems but not necessarily
+// elsewhere. As rewriting the inode changes every name it has, a file
+// with other hard links is only converted when forced.
+func convertInPlace(inFilePath, outFilePath string, meter io.Writer) (res result, err error) {
+	fi, err := os.Lstat(inFilePath)
+	if err != nil {
+		return res, err
+	}
+	if !fi.Mode().IsRegular() {
+		return res, fmt.Errorf("%s is not a regular file", inFilePath)
+	}
+	if n, ok := linkCount(fi); ok && n > 1 && *force == false {
+		return res, fmt.Errorf("%s has %d other link(s). use force to rewrite it in place", inFilePath, n-1)
+	}
+	f, err := os.OpenFile(inFilePath, os.O_RDWR, 0)
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+
+	sp, err := newSpool()
+	if err != nil {
+		return res, err
+	}
+	if _, err = io.Copy(sp, f); err != nil {
+		sp.discard()
+		return res, err
+	}
+
+	rewriting.RLock()
+	defer rewriting.RUnlock()
+	err = writeBack(f, sp, inFilePath, outFilePath, meter, &res)
+	if err == nil {
+		sp.discard()
+		return res, nil
+	}
+
+	if rerr := restore(f, sp); rerr != nil {
+		if fs, ok := sp.(fileSpool); ok {
+			return res, fmt.Errorf("%v; restoring %s failed: %v; original content kept in %s",
+				err, inFilePath, rerr, fs.Name())
+		}
+		return res, fmt.Errorf("%v; restoring %s failed: %v", err, inFilePath, rerr)
+	}
+	sp.discard()
+	return res, err
+}
+
+// writeBack replaces the content of f with the converted spool and links
+// it under outFilePath. The spool is metered as it is converted.
+func writeBack(f *os.File, sp spool, inFilePath, outFilePath string, meter io.Writer, res *result) error {
+	src, err := sp.reader()
+	if err != nil {
+		return err
+	}
+	if meter != nil {
+		src = io.TeeReader(src, meter)
+	}
+	if isInterrupted() {
+		return errInterrupted
+	}
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	err = transform(interruptible{f}, src, res)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if isInterrupted() {
+		return errInterrupted
+	}
+	if err = rename(inFilePath, outFilePath); err != nil {
+		return err
+	}
+	res.outFilePath = outFilePath
+	return nil
+}
+
+// rename moves oldpath to newpath without replacing anything that appeared
+// at newpath in the meantime: os.Link fails on an existing name.
+func rename(oldpath, newpath string) error {
+	err := os.Link(oldpath, newpath)
+	if err == nil {
+		if err = os.Remove(oldpath); err != nil {
+			os.Remove(newpath)
+		}
+		return err
+	}
+	if os.IsExist(err) {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+// restore puts the spooled original content back into f.
+func restore(f *os.File, sp spool) error {
+	src, err := sp.reader()
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, src); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// checkSurvived checks that name still is the file described by fi and
+// holds data.
+func checkSurvived(t *testing.T, name string, fi os.FileInfo, data []byte) {
+	now, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("original gone: %v", err)
+	}
+	if !os.SameFile(fi, now) {
+		t.Error("original replaced by another inode")
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("original content not restored: got %d bytes, want %d", len(b), len(data))
+	}
+}
+
+func TestInPlaceRestore(t *testing.T) {
+	defer func(d bool, td string) { *decompress, *tempDir = d, td }(*decompress, *tempDir)
+
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		decomp bool
+		spool  bool // spool to a file under --tempdir
+		setup  func(t *testing.T, dir, out string)
+	}{
+		{
+			// not bzip2 past the header: decompression fails after the
+			// file has been truncated
+			name:   "failing transform",
+			data:   append([]byte("BZh9"), bytes.Repeat([]byte("junk"), 4096)...),
+			decomp: true,
+		},
+		{
+			name:   "failing transform, spooled to disk",
+			data:   append([]byte("BZh9"), bytes.Repeat([]byte("junk"), 4096)...),
+			decomp: true,
+			spool:  true,
+		},
+		{
+			// a file appearing at the output name makes the link fail
+			name: "failing rename",
+			data: bytes.Repeat([]byte("data"), 4096),
+			setup: func(t *testing.T, dir, out string) {
+				writeFile(t, out, "other")
+			},
+		},
+		{
+			name: "read-only directory",
+			data: bytes.Repeat([]byte("data"), 4096),
+			setup: func(t *testing.T, dir, out string) {
+				if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+					t.Skip("directory permissions not enforced")
+				}
+				if err := os.Chmod(dir, 0555); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			defer os.Chmod(dir, 0755)
+			in := filepath.Join(dir, "x.bz2")
+			out := filepath.Join(dir, "x")
+			if !tc.decomp {
+				in, out = out, in
+			}
+			if err := ioutil.WriteFile(in, tc.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			*decompress = tc.decomp
+			*tempDir = ""
+			if tc.spool {
+				*tempDir = testDir(t)
+				defer os.RemoveAll(*tempDir)
+			}
+			if tc.setup != nil {
+				tc.setup(t, dir, out)
+			}
+
+			if _, err = convertInPlace(in, out, nil); err == nil {
+				t.Fatal("convertInPlace succeeded")
+			}
+			checkSurvived(t, in, fi, tc.data)
+			if tc.spool {
+				left, _ := ioutil.ReadDir(*tempDir)
+				if len(left) != 0 {
+					t.Errorf("spool file left in tempdir: %s", left[0].Name())
+				}
+			}
+		})
+	}
+}
+
+// Rewriting the inode would change the other names of a hard-linked file
+// too, so that needs -f.
+func TestInPlaceHardLink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("link count not available")
+	}
+	defer func(d, f bool) { *decompress, *force = d, f }(*decompress, *force)
+	*decompress = false
+
+	for _, forced := range []bool{false, true} {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		in := filepath.Join(dir, "a")
+		data := bytes.Repeat([]byte("data\n"), 1000)
+		if err := ioutil.WriteFile(in, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(in, filepath.Join(dir, "b")); err != nil {
+			t.Skipf("hard links not supported: %v", err)
+		}
+		fi, err := os.Stat(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		*force = forced
+		_, err = convertInPlace(in, in+".bz2", nil)
+		if forced {
+			if err != nil {
+				t.Errorf("forced: %v", err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatal("hard-linked file rewritten without -f")
+		}
+		checkSurvived(t, in, fi, data)
+		checkSurvived(t, filepath.Join(dir, "b"), fi, data)
+	}
+}
+
+// An interrupt while the file is being rewritten must put the original
+// content back before the process exits.
+func TestInPlaceInterrupt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGINT on windows")
+	}
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "big")
+	data := make([]byte, 32<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := ioutil.WriteFile(in, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := command(t, dir, "bzip2", "--in-place", "big")
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// random data doesn't shrink, so the file is only shorter than the
+	// original once it has been truncated for the write-back
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		now, err := os.Stat(in)
+		if err == nil && now.Size() < fi.Size() {
+			break
+		}
+		if err != nil || time.Now().After(deadline) {
+			cmd.Process.Kill()
+			cmd.Wait()
+			t.Fatalf("write-back not seen: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cmd.Process.Signal(syscall.SIGINT)
+	if err = cmd.Wait(); err == nil {
+		t.Error("interrupted run exited 0")
+	}
+	checkSurvived(t, in, fi, data)
+	if _, err = os.Lstat(in + ".bz2"); !os.IsNotExist(err) {
+		t.Errorf("output name created: %v", err)
+	}
+}
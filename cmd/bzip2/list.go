@@ -0,0 +1,71 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// list scans the archive at inFilePath ("-" for stdin) in a single pass,
+// decompressing into nothing, and prints its compressed and uncompressed
+// sizes. Both are only known at EOF, so the input never has to be seekable.
+func list(inFilePath string) error {
+	name := inFilePath
+	var inFile *os.File
+	if inFilePath == "-" {
+		inFile = os.Stdin
+		name = *stdinName
+	} else {
+		var err error
+		inFile, err = os.Open(inFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	defer inFile.Close()
+
+	cr := &countingReader{r: inFile}
+	z, err := bzip2.NewReader(cr, nil)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	nOut, err := io.Copy(ioutil.Discard, z)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	// the reader may stop short of trailing bytes; count them too
+	if _, err = io.Copy(ioutil.Discard, cr); err != nil {
+		return err
+	}
+
+	if *size == true {
+		fmt.Println(nOut)
+		return nil
+	}
+	var saved float64
+	if nOut > 0 {
+		saved = 100 * (1 - float64(cr.n)/float64(nOut))
+	}
+	fmt.Printf("%12s %12s %6s %s\n", "compressed", "uncompressed", "ratio", "name")
+	fmt.Printf("%12d %12d %5.1f%% %s\n", cr.n, nOut, saved, name)
+	return nil
+}
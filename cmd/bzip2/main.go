@@ -1,6 +1,6 @@
 // Copyright (c) 2010, Andrei Vieru. All rights reserved.
 // Copyright (c) 2021, Pedro Albanese. All rights reserved.
-// Use of this source code is governed by a ISC license that 
+// Use of this source code is governed by a ISC license that
 // can be found in the LICENSE file.
 package main
 
@@ -10,25 +10,56 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
 	"strings"
+	"syscall"
 
 	"github.com/dsnet/compress/bzip2"
 )
 
 var (
-	stdout     = flag.Bool("c", false, "write on standard output, keep original files unchanged")
-	decompress = flag.Bool("d", false, "decompress; see also -c and -k")
-	force      = flag.Bool("f", false, "force overwrite of output file")
-	help       = flag.Bool("h", false, "print this help message")
-	keep       = flag.Bool("k", false, "keep original files unchaned")
-	suffix     = flag.String("s", "bz2", "use provided suffix on compressed files")
-	cores      = flag.Int("cores", 1, "number of cores to use for parallelization")
-
-	stdin bool
+	stdout         = flag.Bool("c", false, "write on standard output, keep original files unchanged")
+	decompress     = flag.Bool("d", false, "decompress; see also -c and -k")
+	force          = flag.Bool("f", false, "force overwrite of output file")
+	help           = flag.Bool("h", false, "print this help message")
+	keep           = flag.Bool("k", false, "keep original files unchaned")
+	suffix         = flag.String("s", "bz2", "use provided suffix on compressed files")
+	cores          = flag.Int("cores", 1, "number of cores to use for parallelization")
+	verbose        = flag.Bool("v", false, "verbose; print compression ratio for the file")
+	renameExisting = flag.Bool("rename-existing", false, "if output file exists, pick a free name (file.1.bz2, ...)")
+	listing        = flag.Bool("l", false, "list compressed and uncompressed size of FILE")
+	size           = flag.Bool("size", false, "print only the uncompressed size of FILE")
+	stdinName      = flag.String("stdin-name", "(stdin)", "name shown for standard input")
+	showProgress   = flag.Bool("progress", false, "show progress, rate and ETA on stderr")
+	memStats       = flag.Bool("mem-stats", false, "report peak memory usage; per file only with -cores=1 in -files-from runs")
+	metricsFile    = flag.String("metrics-file", "", "write run statistics in Prometheus textfile format to `PATH`")
+	inPlace        = flag.Bool("in-place", false, "rewrite each file within its own inode, then rename it")
+	salvage        = flag.Bool("salvage", false, "with -d, skip damaged blocks and keep decompressing; the input is kept")
+	salvageMarker  = flag.String("salvage-marker", "", "write `TEXT` where --salvage skipped data")
+	tee            = flag.String("tee", "", "with -c, also write the output to `FILE`")
+	outputDir      = flag.String("output-dir", "", "write output files under `DIR`, keeping their relative paths")
+	tempDir        = flag.String("tempdir", "", "keep --in-place copies of originals in `DIR` instead of memory")
+	filesFrom      = flag.String("files-from", "", "read names of files to process from `FILE`, one per line (- for stdin)")
+
+	metricsLabels labelsFlag
+	streamEvery   sizeFlag
+	flatten       flattenFlag
+	streamCompare = flag.Bool("stream-compare", false, "with -v and -stream-every, also compress each file as a single stream to report the size overhead; this compresses everything twice")
+	posix         = flag.Bool("posix", false, "strict bzip2 1.0.8 compatibility; also set by POSIXLY_CORRECT")
+
+	stdin   bool
+	level   int // block size in 100k units; 0 for the library default
+	namePad int // width names are padded to in -v lines
 )
 
+func init() {
+	flag.Var(&metricsLabels, "metrics-label", "add constant label `k=v` to metrics; may be repeated")
+	flag.Var(&flatten, "flatten", "with -output-dir, put outputs directly in DIR; on name collisions fail (default), or give -flatten=rename or -flatten=hash (the = is required)")
+	flag.Var(&streamEvery, "stream-every", "start a new bzip2 stream every `SIZE` bytes of input (k, M, G suffixes), so that same-length changes leave later streams byte-identical")
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]... [FILE]\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "Compress or uncompress FILE (by default, compress FILE in-place).\n\n")
@@ -42,6 +73,12 @@ func exit(msg string) {
 	log.Fatalf("%s: check args: %s\n\n", os.Args[0], msg)
 }
 
+// argError is a problem with the command line; in single-file mode it is
+// reported along with the usage text.
+type argError string
+
+func (e argError) Error() string { return string(e) }
+
 func setByUser(name string) (isSet bool) {
 	flag.Visit(func(f *flag.Flag) {
 		if f.Name == name {
@@ -51,198 +88,596 @@ func setByUser(name string) (isSet bool) {
 	return
 }
 
-func main() {
-	flag.Parse()
-	if *help == true {
-		usage()
-		log.Fatal(0)
+// givenBare reports whether the boolean flag name was given without a
+// value, right before the operands: -name, not -name=v or -name --.
+func givenBare(name string) bool {
+	flags := os.Args[1 : len(os.Args)-flag.NArg()]
+	if len(flags) == 0 {
+		return false
 	}
-	//if *stdout == true && *suffix != "bz2" {
-	if *stdout == true && setByUser("s") == true {
-		exit("stdout set, suffix not used")
+	last := flags[len(flags)-1]
+	return last == "-"+name || last == "--"+name
+}
+
+// createOutput creates path for writing. O_EXCL makes the open fail on any
+// existing entry, symlinks included, so a link planted at (or swapped into)
+// the output name can't redirect the write; with -f the old entry has
+// already been removed and a racing re-creation fails rather than wins.
+func createOutput(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+}
+
+// maxRenameAttempts bounds the counter search of --rename-existing.
+const maxRenameAttempts = 9999
+
+// openOutput creates name, or with --rename-existing the first free name
+// from name.1.ext, name.2.ext, ... It returns the name actually created.
+func openOutput(name string) (*os.File, string, error) {
+	f, err := createOutput(name)
+	if err == nil || !os.IsExist(err) || *renameExisting == false {
+		return f, name, err
 	}
-	if *stdout == true && *force == true {
-		exit("stdout set, force not used")
+	for i := 1; i <= maxRenameAttempts; i++ {
+		try := numbered(name, i)
+		f, err = createOutput(try)
+		if err == nil {
+			return f, try, nil
+		}
+		if !os.IsExist(err) {
+			return nil, "", err
+		}
 	}
-	if *stdout == true && *keep == true {
-		exit("stdout set, keep is redundant")
+	return nil, "", fmt.Errorf("no free output name for %s after %d attempts", name, maxRenameAttempts)
+}
+
+// numbered inserts counter i before the extension of name: file.1.bz2.
+func numbered(name string, i int) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), i, ext)
+}
+
+// report prints the -v line for a file, in the format of bzip2 1.0.8.
+func report(name string, nIn, nOut int64) {
+	eprintf("  %s: %s%s", name, pad(name), reportResult(nIn, nOut))
+}
+
+// reportResult is the part of the -v line that follows the name.
+func reportResult(nIn, nOut int64) string {
+	if *decompress {
+		return "done\n"
 	}
-	if flag.NArg() > 1 {
-		exit("too many file, provide at most one file at a time or check order of flags")
+	if nIn == 0 || nOut == 0 {
+		return " no data compressed.\n"
 	}
-	if *cores < 1 || *cores > 32 {
-		exit("invalid number of cores")
+	in, out := float64(nIn), float64(nOut)
+	return fmt.Sprintf("%6.3f:1, %6.3f bits/byte, %5.2f%% saved, %d in, %d out.\n",
+		in/out, 8*out/in, 100*(1-out/in), nIn, nOut)
+}
+
+// pad returns the spaces that align name to namePad columns in -v lines,
+// as upstream aligns them.
+func pad(name string) string {
+	if len(name) >= namePad {
+		return ""
 	}
+	return strings.Repeat(" ", namePad-len(name))
+}
 
-	runtime.GOMAXPROCS(*cores)
+// policy is what --posix changes in how a file is handled: how inputs are
+// vetted, how output names are derived, how an existing output is refused
+// and how -v reports.
+type policy interface {
+	// checkInput vets inFilePath, as found by os.Lstat.
+	checkInput(inFilePath string, f os.FileInfo) error
+	// outputName derives the name of the output file.
+	outputName(inFilePath string) (string, error)
+	// exists is the error for an existing output file when not forced.
+	exists(outFilePath string) error
+	// started and report print the -v output for a file, before and
+	// after it is converted.
+	started(name string)
+	report(name string, nIn, nOut int64)
+}
 
-	var inFilePath string
-	var outFilePath string
-	if flag.NArg() == 0 || flag.NArg() == 1 && flag.Args()[0] == "-" { // parse args: read from stdin
-		if *stdout != true {
-			exit("reading from stdin, can write only to stdout")
-		}
-		//if *suffix != "bzip2" {
-		if setByUser("s") == true {
-			exit("reading from stdin, suffix not needed")
-		}
-		stdin = true
+// pol is the policy in effect.
+var pol policy = defaultPolicy{}
 
-	} else if flag.NArg() == 1 { // parse args: read from file
-		inFilePath = flag.Args()[0]
-		f, err := os.Lstat(inFilePath)
+type defaultPolicy struct{}
+
+func (defaultPolicy) checkInput(inFilePath string, f os.FileInfo) error {
+	if !!f.IsDir() {
+		return argError(fmt.Sprintf("%s is not a regular file", inFilePath))
+	}
+	return nil
+}
+
+func (defaultPolicy) outputName(inFilePath string) (string, error) {
+	if *decompress == false {
+		return inFilePath + "." + *suffix, nil
+	}
+	outFileDir, outFileName := path.Split(inFilePath)
+	if !strings.HasSuffix(outFileName, "."+*suffix) {
+		return "", argError(fmt.Sprintf("file %s doesn't have suffix .%s", inFilePath, *suffix))
+	}
+	if len(outFileName) <= len("."+*suffix) {
+		return "", fmt.Errorf("error: can't strip suffix .%s from file %s", *suffix, inFilePath)
+	}
+	nstr := strings.SplitN(outFileName, ".", len(outFileName))
+	estr := strings.Join(nstr[0:len(nstr)-1], ".")
+	return outFileDir + estr, nil
+}
+
+func (defaultPolicy) exists(outFilePath string) error {
+	return argError(fmt.Sprintf("outFile %s exists. use force to overwrite", outFilePath))
+}
+
+func (defaultPolicy) started(name string) {}
+
+func (defaultPolicy) report(name string, nIn, nOut int64) {
+	report(name, nIn, nOut)
+}
+
+// outputPath returns the output name for inFilePath and checks that it can
+// be written, removing an existing file when forced.
+func outputPath(inFilePath string) (string, error) {
+	f, err := os.Lstat(inFilePath)
+	if err != nil {
+		return "", err
+	}
+	if err = pol.checkInput(inFilePath, f); err != nil {
+		return "", err
+	}
+	if *stdout == true {
+		return "", nil
+	}
+
+	outFilePath, err := pol.outputName(inFilePath)
+	if err != nil {
+		return "", err
+	}
+	if *outputDir != "" {
+		outFilePath, err = placeOutput(inFilePath, outFilePath)
 		if err != nil {
-			log.Fatal(err.Error())
-		}
-		if f == nil {
-			exit(fmt.Sprintf("file %s not found", inFilePath))
-		}
-		if !!f.IsDir() {
-			exit(fmt.Sprintf("%s is not a regular file", inFilePath))
+			return "", err
 		}
+	}
 
-		if *stdout == false { // parse args: write to file
-			if *suffix == "" {
-				exit("suffix can't be an empty string")
+	f, err = os.Lstat(outFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if f != nil && *renameExisting == true {
+		// a free name is chosen when the output is created
+	} else if f != nil && !f.IsDir() {
+		if *force == true {
+			err = os.Remove(outFilePath)
+			if err != nil {
+				return "", err
 			}
+		} else {
+			return "", pol.exists(outFilePath)
+		}
+	} else if f != nil {
+		return "", argError(fmt.Sprintf("outFile %s exists and is not a regular file", outFilePath))
+	}
+	return outFilePath, nil
+}
 
-			if *decompress == true {
-				outFileDir, outFileName := path.Split(inFilePath)
-				if strings.HasSuffix(outFileName, "."+*suffix) {
-					if len(outFileName) > len("."+*suffix) {
-						nstr := strings.SplitN(outFileName, ".", len(outFileName))
-						estr := strings.Join(nstr[0:len(nstr)-1], ".")
-						outFilePath = outFileDir + estr
-					} else {
-						log.Fatalf("error: can't strip suffix .%s from file %s", *suffix, inFilePath)
-					}
-				} else {
-					exit(fmt.Sprintf("file %s doesn't have suffix .%s", inFilePath, *suffix))
-				}
+// result is what process did to one file.
+type result struct {
+	nIn, nOut   int64
+	outFilePath string // name actually written; "" for stdout
+	streams     int    // bzip2 streams written
+	singleOut   int64  // size as a single stream; with --stream-compare
+	skipped     int    // damaged blocks skipped by --salvage
+	lost        int64  // estimated bytes lost with them
+}
 
-			} else {
-				outFilePath = inFilePath + "." + *suffix
+// transform compresses or decompresses src into dst and records the byte
+// counts in res. Reading and (de)compression run in their own goroutine,
+// connected to the writer by a pipe.
+func transform(dst io.Writer, src io.Reader, res *result) (err error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		if *decompress {
+			// read from src into pw
+			res.nIn, err = io.Copy(pw, src)
+		} else {
+			// read from src into z
+			z := &streamWriter{w: pw, every: int64(streamEvery)}
+			var single *streamWriter
+			var singleOut countingWriter
+			if streamEvery > 0 && *verbose == true && *streamCompare == true {
+				// compress a single stream alongside, to report
+				// what the stream boundaries cost; this doubles
+				// the compression work, hence the opt-in
+				single = &streamWriter{w: &singleOut}
+				src = io.TeeReader(src, single)
 			}
-
-			f, err = os.Lstat(outFilePath)
-			if err != nil && f != nil { // should be: ||| if err != nil && err != "file not found" ||| but i can't find the error's id
-				log.Fatal(err.Error())
+			res.nIn, err = io.Copy(z, src)
+			if cerr := z.Close(); err == nil {
+				err = cerr
 			}
-			if f != nil && !f.IsDir() {
-				if *force == true {
-					err = os.Remove(outFilePath)
-					if err != nil {
-						log.Fatal(err.Error())
-					}
-				} else {
-					exit(fmt.Sprintf("outFile %s exists. use force to overwrite", outFilePath))
+			res.streams = z.streams
+			if single != nil {
+				if cerr := single.Close(); err == nil {
+					err = cerr
 				}
-			} else if f != nil {
-				exit(fmt.Sprintf("outFile %s exists and is not a regular file", outFilePath))
+				res.singleOut = singleOut.n
 			}
 		}
-	}
-
-	pr, pw := io.Pipe()
-	//defer pr.Close()
-	//defer pw.Close()
+		pw.CloseWithError(err)
+	}()
 
 	if *decompress {
-		// read from inFile into pw
-		go func() {
-			defer pw.Close()
-			var inFile *os.File
-			var err error
-			if stdin == true {
-				inFile = os.Stdin
-			} else {
-				inFile, err = os.Open(inFilePath)
+		// write into dst from z
+		if *salvage == true {
+			sr := newSalvageReader(pr, *salvageMarker)
+			res.nOut, err = io.Copy(dst, sr)
+			res.skipped, res.lost = sr.skipped, sr.lost()
+		} else {
+			var z *bzip2.Reader
+			z, err = bzip2.NewReader(pr, nil)
+			if err == nil {
+				res.nOut, err = io.Copy(dst, z)
+				z.Close()
 			}
-			defer inFile.Close()
+		}
+	} else {
+		// write into dst from pr
+		res.nOut, err = io.Copy(dst, pr)
+	}
+	pr.CloseWithError(err)
+	<-done
+	return err
+}
+
+// process handles one file: it converts inFilePath (stdin if unset) into
+// outFilePath (stdout with -c), prints the per-file reports, and removes
+// the input unless kept. Input bytes are also written to meter, if any.
+func process(inFilePath, outFilePath string, meter io.Writer) (res result, err error) {
+	// with concurrent files the samples mix them all; only the run-wide
+	// peak is reported then
+	fileMem := sampler != nil && (*filesFrom == "" || *cores == 1)
+	if fileMem {
+		sampler.startFile()
+	}
+	if *verbose == true && stdin == true {
+		pol.started(*stdinName)
+	} else if *verbose == true {
+		pol.started(inFilePath)
+	}
+	if *inPlace == true {
+		res, err = convertInPlace(inFilePath, outFilePath, meter)
+	} else {
+		res, err = convert(inFilePath, outFilePath, meter)
+	}
+	var peak memPeak
+	if fileMem {
+		peak = sampler.endFile()
+	}
+	if err != nil {
+		return res, err
+	}
+
+	name := inFilePath
+	if stdin == true {
+		name = *stdinName
+	} else if res.outFilePath != outFilePath || *outputDir != "" {
+		name += " -> " + res.outFilePath
+	}
+	if *verbose == true && res.skipped > 0 {
+		eprintf("  %s: %sincomplete, %d damaged block(s) skipped\n", name, pad(name), res.skipped)
+	} else if *verbose == true {
+		pol.report(name, res.nIn, res.nOut)
+		if streamEvery > 0 && res.singleOut > 0 {
+			eprintf("  %s: %s%d streams, %+.2f%% size versus a single stream\n", name, pad(name),
+				res.streams, 100*(float64(res.nOut)/float64(res.singleOut)-1))
+		} else if streamEvery > 0 {
+			eprintf("  %s: %s%d streams\n", name, pad(name), res.streams)
+		}
+	}
+	if fileMem {
+		reportMem(name, peak)
+	}
+
+	if res.skipped > 0 {
+		return res, salvageError(res)
+	}
+	if *stdout == false && *keep == false && *inPlace == false && *salvage == false {
+		err = os.Remove(inFilePath)
+	}
+	return res, err
+}
+
+// convert writes the converted inFilePath to a new outFilePath. On failure
+// the partial output is removed.
+func convert(inFilePath, outFilePath string, meter io.Writer) (res result, err error) {
+	var inFile *os.File
+	if stdin == true {
+		inFile = os.Stdin
+	} else {
+		inFile, err = os.Open(inFilePath)
+		if err != nil {
+			return res, err
+		}
+	}
+	defer inFile.Close()
+	var in io.Reader = inFile
+	if meter != nil {
+		in = io.TeeReader(inFile, meter)
+	}
+
+	var outFile *os.File
+	if *stdout == true {
+		outFile = os.Stdout
+	} else {
+		outFile, res.outFilePath, err = openOutput(outFilePath)
+		if err != nil {
+			return res, err
+		}
+		defer func() {
 			if err != nil {
-				log.Fatal(err.Error())
+				outFile.Close()
+				os.Remove(res.outFilePath)
 			}
+		}()
+	}
 
-			_, err = io.Copy(pw, inFile)
+	var out io.Writer = outFile
+	if *tee != "" {
+		var teeFile *os.File
+		teeFile, err = openTee(*tee)
+		if err != nil {
+			return res, err
+		}
+		defer func() {
+			if cerr := teeFile.Close(); err == nil {
+				err = cerr
+			}
 			if err != nil {
-				log.Fatal(err.Error())
+				os.Remove(*tee)
 			}
-
 		}()
+		out = io.MultiWriter(outFile, teeFile)
+	}
 
-		// write into outFile from z
-		defer pr.Close()
-		z, _ := bzip2.NewReader(pr, nil)
-		defer z.Close()
-		var outFile *os.File
-		var err error
-		if *stdout == true {
-			outFile = os.Stdout
-		} else {
-			outFile, err = os.Create(outFilePath)
+	err = transform(out, in, &res)
+	if err == nil && *stdout == false {
+		err = outFile.Close()
+	}
+	return res, err
+}
+
+// openTee creates the --tee copy of the output with the checks of a
+// regular output file: an existing file is only replaced when forced.
+func openTee(name string) (*os.File, error) {
+	f, err := os.Lstat(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if f != nil && f.IsDir() {
+		return nil, fmt.Errorf("tee file %s exists and is not a regular file", name)
+	}
+	if f != nil {
+		if *force == false {
+			return nil, fmt.Errorf("tee file %s exists. use force to overwrite", name)
 		}
-		defer outFile.Close()
-		if err != nil {
-			log.Fatal(err.Error())
+		if err = os.Remove(name); err != nil {
+			return nil, err
 		}
+	}
+	return createOutput(name)
+}
 
-		_, err = io.Copy(outFile, z)
-		if err != nil {
+// trapSignals handles SIGINT and SIGTERM: files being rewritten in place
+// are restored, and the metrics written, before exiting.
+func trapSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		close(interrupted)
+		rewriting.Lock()
+		if err := writeMetrics(); err != nil {
+			log.Print(err.Error())
+		}
+		log.Fatalf("%s: caught %v", os.Args[0], s)
+	}()
+}
+
+func main() {
+	if posixMode(os.Args[1:]) {
+		*posix = true
+		os.Exit(posixMain(os.Args[1:]))
+	}
+	flag.Parse()
+	if *help == true {
+		usage()
+		log.Fatal(0)
+	}
+	if *listing == true || *size == true {
+		if flag.NArg() > 1 {
+			exit("too many file, provide at most one file at a time or check order of flags")
+		}
+		inFilePath := "-"
+		if flag.NArg() == 1 {
+			inFilePath = flag.Args()[0]
+		}
+		if err := list(inFilePath); err != nil {
 			log.Fatal(err.Error())
 		}
+		return
+	}
+	//if *stdout == true && *suffix != "bz2" {
+	if *stdout == true && setByUser("s") == true {
+		exit("stdout set, suffix not used")
+	}
+	if *stdout == true && *force == true && *tee == "" {
+		exit("stdout set, force not used")
+	}
+	if *outputDir != "" && *stdout == true {
+		exit("stdout set, output-dir not used")
+	}
+	if *outputDir != "" && *inPlace == true {
+		exit("in-place and output-dir are mutually exclusive")
+	}
+	if flatten != "" && *outputDir == "" {
+		exit("flatten is only used with output-dir")
+	}
+	if flag.NArg() > 0 && isFlattenMode(flag.Arg(0)) && givenBare("flatten") {
+		// "--flatten rename" parses as a bare --flatten and a file
+		exit("flatten mode must be given as -flatten=" + flag.Arg(0))
+	}
+	if *tee != "" && *stdout == false {
+		exit("tee only applies when writing to stdout")
+	}
+	if *stdout == true && *keep == true {
+		exit("stdout set, keep is redundant")
+	}
+	if *renameExisting == true && *stdout == true {
+		exit("stdout set, rename-existing not used")
+	}
+	if *renameExisting == true && *force == true {
+		exit("force and rename-existing are mutually exclusive")
+	}
+	if *inPlace == true && *stdout == true {
+		exit("stdout set, in-place not used")
+	}
+	if *inPlace == true && *keep == true {
+		exit("in-place replaces the original, keep not possible")
+	}
+	if *inPlace == true && *renameExisting == true {
+		exit("in-place and rename-existing are mutually exclusive")
+	}
+	if *tempDir != "" && *inPlace == false {
+		exit("tempdir is only used with in-place")
+	}
+	if *salvage == true && *decompress == false {
+		exit("salvage only applies to decompression")
+	}
+	if *salvage == true && *inPlace == true {
+		exit("salvage keeps the original, in-place not possible")
+	}
+	if setByUser("salvage-marker") == true && *salvage == false {
+		exit("salvage-marker is only used with salvage")
+	}
+	if streamEvery > 0 && *decompress == true {
+		exit("decompress set, stream-every not used")
+	}
+	if *streamCompare == true && (streamEvery == 0 || *verbose == false) {
+		exit("stream-compare needs stream-every and v")
+	}
+	if flag.NArg() > 1 {
+		exit("too many file, provide at most one file at a time or check order of flags")
+	}
+	if *cores < 1 || *cores > 32 {
+		exit("invalid number of cores")
+	}
+	if *stdout == false && *suffix == "" {
+		exit("suffix can't be an empty string")
+	}
 
-	} else {
-		// read from inFile into z
-		go func() {
-			defer pw.Close()
-			var z io.WriteCloser
-			var inFile *os.File
-			var err error
-			if stdin == true {
-				inFile = os.Stdin
-				defer inFile.Close()
-				z, _ = bzip2.NewWriter(pw, nil)
-				defer z.Close()
-			} else {
-				inFile, err = os.Open(inFilePath)
-				defer inFile.Close()
-				if err != nil {
-					log.Fatal(err.Error())
-				}
-				z, _ = bzip2.NewWriter(pw, nil)
-				defer z.Close()
-			}
+	runtime.GOMAXPROCS(*cores)
 
-			_, err = io.Copy(z, inFile)
-			if err != nil {
-				log.Fatal(err.Error())
-			}
-		}()
+	if *metricsFile != "" || *inPlace == true {
+		trapSignals()
+	}
+	if *tee != "" {
+		// a closed stdout must fail the write with EPIPE rather than
+		// kill the process, so the partial tee file is removed
+		signal.Ignore(syscall.SIGPIPE)
+	}
 
-		// write into outFile from pr
-		defer pr.Close()
-		var outFile *os.File
-		var err error
+	if *filesFrom != "" {
+		if flag.NArg() > 0 {
+			exit("files-from set, no FILE argument expected")
+		}
 		if *stdout == true {
-			outFile = os.Stdout
-		} else {
-			outFile, err = os.Create(outFilePath)
+			exit("files-from set, can't write several files to stdout")
+		}
+		err := processList(*filesFrom)
+		if merr := writeMetrics(); err == nil {
+			err = merr
+		}
+		if _, ok := err.(incompleteError); ok {
+			log.Print(err.Error())
+			os.Exit(exitCorrupt)
 		}
-		defer outFile.Close()
 		if err != nil {
 			log.Fatal(err.Error())
 		}
+		return
+	}
+
+	var inFilePath string
+	var outFilePath string
+	if flag.NArg() == 0 || flag.NArg() == 1 && flag.Args()[0] == "-" { // parse args: read from stdin
+		if *stdout != true {
+			exit("reading from stdin, can write only to stdout")
+		}
+		//if *suffix != "bzip2" {
+		if setByUser("s") == true {
+			exit("reading from stdin, suffix not needed")
+		}
+		stdin = true
 
-		_, err = io.Copy(outFile, pr)
+	} else if flag.NArg() == 1 { // parse args: read from file
+		inFilePath = flag.Args()[0]
+		var err error
+		outFilePath, err = outputPath(inFilePath)
 		if err != nil {
+			// the run ends here; it still counts as a failed file
+			run.add(result{}, err)
+			if merr := writeMetrics(); merr != nil {
+				log.Print(merr.Error())
+			}
+		}
+		if ae, ok := err.(argError); ok {
+			exit(string(ae))
+		} else if err != nil {
 			log.Fatal(err.Error())
 		}
 	}
 
-	if *stdout == false && *keep == false {
-		err := os.Remove(inFilePath)
-		if err != nil {
-			log.Fatal(err.Error())
+	var prog *progress
+	var meter io.Writer
+	if *showProgress == true {
+		name, total := inFilePath, int64(-1)
+		fi, err := os.Stat(inFilePath)
+		if stdin == true {
+			name = *stdinName
+			fi, err = os.Stdin.Stat()
+		}
+		if err == nil && fi.Mode().IsRegular() {
+			total = fi.Size()
 		}
+		prog = newProgress(name, total)
+		meter = prog
+	}
+
+	if *memStats == true {
+		sampler = startMemSampler()
+	}
+	res, err := process(inFilePath, outFilePath, meter)
+	if prog != nil {
+		prog.Close()
+	}
+	if sampler != nil {
+		sampler.Stop()
+	}
+	run.add(res, err)
+	if merr := writeMetrics(); err == nil {
+		err = merr
+	}
+	if _, ok := err.(incompleteError); ok {
+		log.Printf("%s: %v", inFilePath, err)
+		os.Exit(exitCorrupt)
+	}
+	if err != nil {
+		log.Fatal(err.Error())
 	}
 }
@@ -0,0 +1,223 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// The test binary doubles as the command: with BZIP2_TEST_MAIN set it runs
+// main on its arguments, so tests can run whole invocations.
+func TestMain(m *testing.M) {
+	if os.Getenv("BZIP2_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// command returns a command running the program as argv0 with args in dir.
+func command(t *testing.T, dir, argv0 string, args ...string) *exec.Cmd {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Args[0] = argv0
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "BZIP2_TEST_MAIN=1")
+	return cmd
+}
+
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bzip2-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, name, data string) {
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// plantLink points name at a victim file holding "secret" and returns the
+// victim's path, skipping the test where symlinks can't be made.
+func plantLink(t *testing.T, dir, name string) string {
+	victim := filepath.Join(dir, "victim")
+	writeFile(t, victim, "secret")
+	if err := os.Symlink(victim, filepath.Join(dir, name)); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	return victim
+}
+
+func checkVictim(t *testing.T, victim string) {
+	b, err := ioutil.ReadFile(victim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("secret")) {
+		t.Errorf("victim overwritten: %q", b)
+	}
+}
+
+func isLink(name string) bool {
+	fi, err := os.Lstat(name)
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
+
+func TestCreateOutputRefusesSymlink(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	victim := plantLink(t, dir, "x.bz2")
+
+	f, err := createOutput(filepath.Join(dir, "x.bz2"))
+	if err == nil {
+		f.Close()
+		t.Fatal("createOutput followed the symlink")
+	}
+	if !os.IsExist(err) {
+		t.Errorf("got %v, want EEXIST", err)
+	}
+	checkVictim(t, victim)
+}
+
+// With -f the existing entry is removed first; a link planted again before
+// the output is created must make the open fail, not redirect it.
+func TestForceRaceRefusesSymlink(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "x")
+	writeFile(t, in, "data")
+	victim := plantLink(t, dir, "x.bz2")
+
+	defer func(f bool) { *force = f }(*force)
+	*force = true
+	out, err := outputPath(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(victim, out); err != nil {
+		t.Fatal(err)
+	}
+	f, _, err := openOutput(out)
+	if err == nil {
+		f.Close()
+		t.Fatal("openOutput followed the symlink")
+	}
+	if !os.IsExist(err) {
+		t.Errorf("got %v, want EEXIST", err)
+	}
+	checkVictim(t, victim)
+}
+
+func TestSymlinkAttack(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		link   string // planted output name
+		args   []string
+		failed bool
+	}{
+		{"output", "x.bz2", []string{"x"}, true},
+		{"output forced", "x.bz2", []string{"-f", "x"}, false},
+		{"tee", "copy.bz2", []string{"-c", "--tee=copy.bz2", "x"}, true},
+		{"tee forced", "copy.bz2", []string{"-c", "-f", "--tee=copy.bz2", "x"}, false},
+		{"in-place", "x.bz2", []string{"--in-place", "x"}, true},
+		{"in-place forced", "x.bz2", []string{"--in-place", "-f", "x"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			writeFile(t, filepath.Join(dir, "x"), "data")
+			victim := plantLink(t, dir, tc.link)
+
+			cmd := command(t, dir, "bzip2", tc.args...)
+			cmd.Stdout = ioutil.Discard
+			err := cmd.Run()
+			if tc.failed && err == nil {
+				t.Error("run succeeded over a planted symlink")
+			}
+			if !tc.failed && err != nil {
+				t.Errorf("run failed: %v", err)
+			}
+			checkVictim(t, victim)
+			if !tc.failed && isLink(filepath.Join(dir, tc.link)) {
+				t.Errorf("%s is still a symlink", tc.link)
+			}
+		})
+	}
+}
+
+// The in-place rename links the file under its new name; a link planted
+// there in the meantime must make it fail and leave both names alone.
+func TestRenameRefusesSymlink(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "x")
+	writeFile(t, in, "data")
+	victim := plantLink(t, dir, "x.bz2")
+
+	err := rename(in, filepath.Join(dir, "x.bz2"))
+	if !os.IsExist(err) {
+		t.Errorf("got %v, want EEXIST", err)
+	}
+	checkVictim(t, victim)
+	if _, err = os.Stat(in); err != nil {
+		t.Errorf("source lost: %v", err)
+	}
+	if !isLink(filepath.Join(dir, "x.bz2")) {
+		t.Error("planted link replaced")
+	}
+}
+
+// When stdout goes away mid-run the write must fail, not kill the process,
+// so the partial --tee copy is cleaned up.
+func TestTeeRemovedOnClosedStdout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGPIPE on windows")
+	}
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	// random data doesn't compress, so the output outgrows the pipe buffer
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := ioutil.WriteFile(filepath.Join(dir, "x"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := command(t, dir, "bzip2", "-c", "--tee=copy.bz2", "x")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(stdout, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Close()
+	err = cmd.Wait()
+	if err == nil {
+		t.Fatal("run succeeded with stdout closed")
+	}
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		t.Errorf("killed by %v", ws.Signal())
+	}
+	if _, err = os.Lstat(filepath.Join(dir, "copy.bz2")); !os.IsNotExist(err) {
+		t.Errorf("partial tee file left behind: %v", err)
+	}
+}
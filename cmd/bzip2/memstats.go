@@ -0,0 +1,138 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// memSampleInterval is how often --mem-stats reads runtime.MemStats.
+// ReadMemStats stops the world briefly, so it is sampled on a ticker
+// rather than per write.
+const memSampleInterval = 100 * time.Millisecond
+
+// memPeak holds the highest values seen while sampling.
+type memPeak struct {
+	HeapInuse uint64
+	Sys       uint64
+	RSS       uint64 // peak resident set size; 0 where unsupported
+}
+
+func (m *memPeak) max(o memPeak) {
+	if o.HeapInuse > m.HeapInuse {
+		m.HeapInuse = o.HeapInuse
+	}
+	if o.Sys > m.Sys {
+		m.Sys = o.Sys
+	}
+	if o.RSS > m.RSS {
+		m.RSS = o.RSS
+	}
+}
+
+func (m memPeak) String() string {
+	s := fmt.Sprintf("heap %s, sys %s", humanBytes(float64(m.HeapInuse)), humanBytes(float64(m.Sys)))
+	if m.RSS > 0 {
+		s += ", rss " + humanBytes(float64(m.RSS))
+	}
+	return s
+}
+
+// memSampler records peak memory usage until stopped: for the whole run,
+// and for the file being processed. A single sampler serves the run, so
+// per-file peaks only mean something when files are processed one at a
+// time.
+type memSampler struct {
+	mu      sync.Mutex
+	peak    memPeak
+	file    memPeak // since startFile
+	fileRSS bool    // the RSS peak was reset by startFile
+	stop    chan struct{}
+	exit    chan struct{}
+}
+
+// sampler is the run's sampler with --mem-stats, nil otherwise.
+var sampler *memSampler
+
+func startMemSampler() *memSampler {
+	s := &memSampler{stop: make(chan struct{}), exit: make(chan struct{})}
+	s.sample()
+	go s.run()
+	return s
+}
+
+func (s *memSampler) run() {
+	defer close(s.exit)
+	t := time.NewTicker(memSampleInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.sample()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *memSampler) sample() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	m := memPeak{HeapInuse: ms.HeapInuse, Sys: ms.Sys}
+	s.mu.Lock()
+	s.peak.max(m)
+	s.file.max(m)
+	s.mu.Unlock()
+}
+
+// startFile starts a new per-file peak. The kernel keeps a single RSS
+// peak for the process, so it is folded into the run's peak and reset;
+// where it can't be reset, per-file peaks go without RSS.
+func (s *memSampler) startFile() {
+	s.mu.Lock()
+	s.file = memPeak{}
+	s.foldRSS()
+	s.fileRSS = resetPeakRSS()
+	s.mu.Unlock()
+	s.sample()
+}
+
+// endFile returns the peaks since startFile.
+func (s *memSampler) endFile() memPeak {
+	s.sample()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.file
+	if rss, ok := peakRSS(); ok && s.fileRSS {
+		m.RSS = rss
+	}
+	return m
+}
+
+// foldRSS adds the process RSS peak to the run's peak. s.mu must be held.
+func (s *memSampler) foldRSS() {
+	if rss, ok := peakRSS(); ok && rss > s.peak.RSS {
+		s.peak.RSS = rss
+	}
+}
+
+// Stop ends sampling and returns the peaks of the run, including the
+// process RSS peak where the platform reports one.
+func (s *memSampler) Stop() memPeak {
+	close(s.stop)
+	<-s.exit
+	s.sample()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.foldRSS()
+	return s.peak
+}
+
+// reportMem prints the --mem-stats line for a file.
+func reportMem(name string, m memPeak) {
+	eprintf("  %s: peak memory %s\n", name, m)
+}
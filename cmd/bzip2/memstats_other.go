@@ -0,0 +1,17 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+// peakRSS and resetPeakRSS are only available on Linux.
+func peakRSS() (uint64, bool) {
+	return 0, false
+}
+
+func resetPeakRSS() bool {
+	return false
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runStats accumulates what a run did, for the -v totals and
+// --metrics-file.
+type runStats struct {
+	mu         sync.Mutex
+	start      time.Time
+	processed  int64
+	failed     int64
+	incomplete int64 // failed, but with partial output kept
+	nIn, nOut  int64
+}
+
+var run = runStats{start: time.Now()}
+
+// add records the outcome of one file.
+func (s *runStats) add(res result, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := err.(incompleteError); ok {
+		s.incomplete++
+	}
+	if err != nil {
+		s.failed++
+	} else {
+		s.processed++
+	}
+	s.nIn += res.nIn
+	s.nOut += res.nOut
+}
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// labelsFlag collects repeated -metrics-label=k=v flags. Set rejects
+// malformed labels, so they fail at startup like any other bad flag.
+type labelsFlag struct {
+	names  []string
+	values []string
+}
+
+func (l *labelsFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	pairs := make([]string, len(l.names))
+	for i := range l.names {
+		pairs[i] = l.names[i] + "=" + l.values[i]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l *labelsFlag) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("label %q is not of the form k=v", v)
+	}
+	k := v[:i]
+	if !labelName.MatchString(k) || strings.HasPrefix(k, "__") {
+		return fmt.Errorf("invalid label name %q", k)
+	}
+	for _, n := range l.names {
+		if n == k {
+			return fmt.Errorf("duplicate label %q", k)
+		}
+	}
+	l.names = append(l.names, k)
+	l.values = append(l.values, v[i+1:])
+	return nil
+}
+
+// format renders the labels as {k="v",...}, or "" if there are none.
+func (l *labelsFlag) format() string {
+	if len(l.names) == 0 {
+		return ""
+	}
+	esc := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, len(l.names))
+	for i := range l.names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, l.names[i], esc.Replace(l.values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// writeMetrics writes the run statistics to --metrics-file in the
+// Prometheus text format. The file is fully rewritten through a temporary
+// file and a rename, so a scraper never sees it half written.
+func writeMetrics() error {
+	if *metricsFile == "" {
+		return nil
+	}
+	now := time.Now()
+	run.mu.Lock()
+	metrics := []struct {
+		name, typ, help string
+		value           float64
+	}{
+		{"bzip2_files_processed_total", "counter", "Files processed successfully.", float64(run.processed)},
+		{"bzip2_files_failed_total", "counter", "Files that failed.", float64(run.failed)},
+		{"bzip2_bytes_in_total", "counter", "Bytes read from input files.", float64(run.nIn)},
+		{"bzip2_bytes_out_total", "counter", "Bytes written to output files.", float64(run.nOut)},
+		{"bzip2_run_duration_seconds", "gauge", "Duration of the run.", now.Sub(run.start).Seconds()},
+		{"bzip2_last_run_timestamp_seconds", "gauge", "Unix time the run ended.", float64(now.UnixNano()) / 1e9},
+	}
+	run.mu.Unlock()
+
+	var buf bytes.Buffer
+	labels := metricsLabels.format()
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", m.name, m.typ)
+		fmt.Fprintf(&buf, "%s%s %s\n", m.name, labels, strconv.FormatFloat(m.value, 'f', -1, 64))
+	}
+
+	dir, base := filepath.Split(*metricsFile)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), *metricsFile)
+}
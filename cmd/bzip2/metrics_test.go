@@ -0,0 +1,114 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLabelsFlagSet(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		err  string // "" for success
+	}{
+		{[]string{"host=a", "job=b c"}, ""},
+		{[]string{"empty="}, ""},
+		{[]string{"v=a=b"}, ""},
+		{[]string{"host"}, "not of the form k=v"},
+		{[]string{"=a"}, "invalid label name"},
+		{[]string{"1host=a"}, "invalid label name"},
+		{[]string{"ho-st=a"}, "invalid label name"},
+		{[]string{"__name__=a"}, "invalid label name"},
+		{[]string{"host=a", "host=b"}, "duplicate label"},
+	} {
+		var l labelsFlag
+		var err error
+		for _, a := range tc.args {
+			if err = l.Set(a); err != nil {
+				break
+			}
+		}
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%q: %v", tc.args, err)
+		case tc.err != "" && err == nil:
+			t.Errorf("%q: accepted", tc.args)
+		case tc.err != "" && !strings.Contains(err.Error(), tc.err):
+			t.Errorf("%q: got %v, want %s", tc.args, err, tc.err)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	defer func(f string, l labelsFlag) { *metricsFile, metricsLabels = f, l }(*metricsFile, metricsLabels)
+	*metricsFile = filepath.Join(dir, "m.prom")
+	metricsLabels = labelsFlag{}
+	if err := metricsLabels.Set("path=C:\\tmp \"x\"\nend"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(*metricsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, want := range []string{
+		"# HELP bzip2_files_failed_total Files that failed.\n",
+		"# TYPE bzip2_files_failed_total counter\n",
+		"# TYPE bzip2_run_duration_seconds gauge\n",
+		`bzip2_files_processed_total{path="C:\\tmp \"x\"\nend"} `,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	left, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 {
+		t.Errorf("temporary file left behind: %d entries", len(left))
+	}
+}
+
+// A file that fails before it is converted is still counted, and the
+// metrics file written.
+func TestMetricsOnEarlyFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files []string
+		arg   string
+	}{
+		{"output exists", []string{"a", "a.bz2"}, "a"},
+		{"missing input", nil, "nosuch"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			for _, f := range tc.files {
+				writeFile(t, filepath.Join(dir, f), "data")
+			}
+			cmd := command(t, dir, "bzip2", "-metrics-file=m.prom", tc.arg)
+			if err := cmd.Run(); err == nil {
+				t.Fatal("run succeeded")
+			}
+			b, err := ioutil.ReadFile(filepath.Join(dir, "m.prom"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), "\nbzip2_files_failed_total 1\n") {
+				t.Errorf("failure not counted:\n%s", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// flattenFlag is the --flatten mode. Given bare it means "fail"; as it is
+// a boolean flag, any other mode must be joined to it with "=".
+type flattenFlag string
+
+func (f *flattenFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return string(*f)
+}
+
+func (f *flattenFlag) Set(v string) error {
+	switch v {
+	case "true":
+		*f = "fail"
+	case "false":
+		*f = ""
+	case "fail", "rename", "hash":
+		*f = flattenFlag(v)
+	default:
+		return fmt.Errorf("unknown flatten mode %q, want fail, rename or hash", v)
+	}
+	return nil
+}
+
+func (f *flattenFlag) IsBoolFlag() bool { return true }
+
+// isFlattenMode reports whether v names a --flatten mode.
+func isFlattenMode(v string) bool {
+	return v == "fail" || v == "rename" || v == "hash"
+}
+
+// claims maps each output name placed by --flatten in this run to its
+// source, so that two sources never share an output.
+var claims = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+// placeOutput moves the output name of inFilePath under --output-dir:
+// at the same relative path, or with --flatten directly in the directory.
+func placeOutput(inFilePath, outFilePath string) (string, error) {
+	if flatten != "" {
+		return flattenOutput(inFilePath, filepath.Base(outFilePath))
+	}
+	rel := filepath.Clean(outFilePath)
+	if filepath.IsAbs(rel) {
+		rel = strings.TrimPrefix(rel, filepath.VolumeName(rel))
+		rel = strings.TrimLeft(rel, string(filepath.Separator))
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("can't place %s under output-dir, use --flatten", inFilePath)
+	}
+	placed := filepath.Join(*outputDir, rel)
+	if err := os.MkdirAll(filepath.Dir(placed), 0777); err != nil {
+		return "", err
+	}
+	return placed, nil
+}
+
+// flattenOutput places base directly in --output-dir and resolves name
+// collisions within the run as --flatten says: fail, number the name, or
+// prefix it with a hash of the source directory.
+func flattenOutput(inFilePath, base string) (string, error) {
+	src, err := filepath.Abs(inFilePath)
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(*outputDir, 0777); err != nil {
+		return "", err
+	}
+	if flatten == "hash" {
+		h := fnv.New32a()
+		h.Write([]byte(filepath.Dir(src)))
+		base = fmt.Sprintf("%08x-%s", h.Sum32(), base)
+	}
+
+	claims.Lock()
+	defer claims.Unlock()
+	name := filepath.Join(*outputDir, base)
+	if flatten == "rename" {
+		for i := 1; claims.m[name] != "" && claims.m[name] != src; i++ {
+			if i > maxRenameAttempts {
+				return "", fmt.Errorf("no free output name for %s after %d attempts", name, maxRenameAttempts)
+			}
+			name = numbered(filepath.Join(*outputDir, base), i)
+		}
+	}
+	if other := claims.m[name]; other != "" && other != src {
+		return "", fmt.Errorf("%s: name collision with %s", name, other)
+	}
+	claims.m[name] = src
+	return name, nil
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	stdbzip2 "compress/bzip2"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// With --flatten=rename the numbered names follow the list order, however
+// the workers are scheduled.
+func TestFlattenRenameOrder(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	var list []string
+	for i := 0; i < 8; i++ {
+		sub := filepath.Join(dir, fmt.Sprint("d", i))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		// the first files are the largest, so later ones tend to
+		// be picked up while they are still being compressed
+		writeFile(t, filepath.Join(sub, "x"), strings.Repeat(fmt.Sprint(i), (8-i)<<16))
+		list = append(list, filepath.Join(sub, "x"))
+	}
+	writeFile(t, filepath.Join(dir, "list"), strings.Join(list, "\n")+"\n")
+
+	for run := 0; run < 5; run++ {
+		out := filepath.Join(dir, fmt.Sprint("out", run))
+		cmd := command(t, dir, "bzip2", "-k", "-cores=4", "-output-dir="+out, "-flatten=rename", "-files-from=list")
+		if b, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("run %d: %v\n%s", run, err, b)
+		}
+		for i := range list {
+			name := filepath.Join(out, "x.bz2")
+			if i > 0 {
+				name = numbered(name, i)
+			}
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(stdbzip2.NewReader(f))
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) == 0 || string(b[:1]) != fmt.Sprint(i) {
+				t.Errorf("run %d: %s is not from %s", run, name, list[i])
+			}
+		}
+	}
+}
+
+// "--flatten rename" would take rename as a file; it must be refused, but
+// a file of that name can still be given after an explicit mode or --.
+func TestFlattenBareMode(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		refused bool
+	}{
+		{[]string{"-flatten", "rename", "x"}, true},
+		{[]string{"--flatten", "hash"}, true},
+		{[]string{"-flatten=fail", "rename"}, false},
+		{[]string{"-flatten", "--", "rename"}, false},
+		{[]string{"-flatten", "x"}, false},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			writeFile(t, filepath.Join(dir, "x"), "data")
+			writeFile(t, filepath.Join(dir, "rename"), "data")
+
+			args := append([]string{"-k", "-output-dir=out"}, tc.args...)
+			b, err := command(t, dir, "bzip2", args...).CombinedOutput()
+			refused := strings.Contains(string(b), "flatten mode must be given as -flatten=")
+			if refused != tc.refused {
+				t.Errorf("refused %v, want %v:\n%s", refused, tc.refused, b)
+			}
+			if !tc.refused && err != nil {
+				t.Errorf("run failed: %v\n%s", err, b)
+			}
+		})
+	}
+}
+
+// runList runs the command on the files in names with extra args, via
+// --files-from, and returns its stderr.
+func runList(t *testing.T, dir string, names []string, args ...string) (string, error) {
+	writeFile(t, filepath.Join(dir, "list"), strings.Join(names, "\n")+"\n")
+	cmd := command(t, dir, "bzip2", append(args, "-files-from=list")...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stderr.String(), err
+}
+
+// sameNamedFiles makes d1/x, d2/x, ... holding "1", "2", ...
+func sameNamedFiles(t *testing.T, dir string, n int) []string {
+	var names []string
+	for i := 1; i <= n; i++ {
+		sub := filepath.Join(dir, fmt.Sprint("d", i))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(sub, "x"), fmt.Sprint(i))
+		names = append(names, filepath.Join(sub, "x"))
+	}
+	return names
+}
+
+func decompressFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(stdbzip2.NewReader(f))
+	return string(b), err
+}
+
+// readBz2 returns the decompressed content of name.
+func readBz2(t *testing.T, name string) string {
+	s, err := decompressFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// By default a second file for a name already taken fails, naming the
+// file that took it, and is left alone.
+func TestFlattenFail(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	names := sameNamedFiles(t, dir, 2)
+
+	stderr, err := runList(t, dir, names, "-output-dir=out", "-flatten")
+	if err == nil {
+		t.Error("run with a collision succeeded")
+	}
+	want := filepath.Join("out", "x.bz2") + ": name collision with " + names[0]
+	if !strings.Contains(stderr, want) {
+		t.Errorf("no %q in:\n%s", want, stderr)
+	}
+	if got := readBz2(t, filepath.Join(dir, "out", "x.bz2")); got != "1" {
+		t.Errorf("out/x.bz2 holds %q, want the first file", got)
+	}
+	if _, err = os.Stat(names[1]); err != nil {
+		t.Errorf("second input not kept: %v", err)
+	}
+	if left, _ := ioutil.ReadDir(filepath.Join(dir, "out")); len(left) != 1 {
+		t.Errorf("%d outputs, want 1", len(left))
+	}
+}
+
+// --flatten=hash names depend only on the source directory.
+func TestFlattenHash(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	names := sameNamedFiles(t, dir, 3)
+
+	var runs [2][]string
+	for r := range runs {
+		out := filepath.Join(dir, fmt.Sprint("out", r))
+		if stderr, err := runList(t, dir, names, "-k", "-output-dir="+out, "-flatten=hash"); err != nil {
+			t.Fatalf("%v\n%s", err, stderr)
+		}
+		files, err := ioutil.ReadDir(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := map[string]bool{}
+		for _, f := range files {
+			runs[r] = append(runs[r], f.Name())
+			if !strings.HasSuffix(f.Name(), "-x.bz2") {
+				t.Errorf("unexpected name %s", f.Name())
+			}
+			seen[readBz2(t, filepath.Join(out, f.Name()))] = true
+		}
+		if len(files) != len(names) || len(seen) != len(names) {
+			t.Errorf("%d outputs from %d sources, want %d", len(files), len(seen), len(names))
+		}
+	}
+	if strings.Join(runs[0], " ") != strings.Join(runs[1], " ") {
+		t.Errorf("names changed between runs: %v, %v", runs[0], runs[1])
+	}
+}
+
+// Without --flatten outputs keep their relative path under --output-dir,
+// and a path leaving the current directory is refused.
+func TestOutputDirRelative(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "work")
+	if err := os.MkdirAll(filepath.Join(sub, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(sub, "a", "b", "x"), "data")
+	writeFile(t, filepath.Join(dir, "up"), "data")
+
+	cmd := command(t, sub, "bzip2", "-k", "-output-dir=out", filepath.Join("a", "b", "x"))
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, b)
+	}
+	if got := readBz2(t, filepath.Join(sub, "out", "a", "b", "x.bz2")); got != "data" {
+		t.Errorf("got %q", got)
+	}
+
+	cmd = command(t, sub, "bzip2", "-k", "-output-dir=out", filepath.Join("..", "up"))
+	b, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Error("path leaving the directory accepted")
+	}
+	if !strings.Contains(string(b), "use --flatten") {
+		t.Errorf("unexpected error:\n%s", b)
+	}
+	for _, name := range []string{filepath.Join(dir, "up.bz2"), filepath.Join(dir, "out")} {
+		if _, err = os.Lstat(name); !os.IsNotExist(err) {
+			t.Errorf("%s created", name)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Exit codes of bzip2 1.0.8.
+const (
+	exitOK       = 0
+	exitEnv      = 1 // environmental problem: missing file, bad flag, I/O error
+	exitCorrupt  = 2 // corrupt compressed input
+	exitInternal = 3 // internal consistency error
+)
+
+// posixMode reports whether --posix is among the flags in args, or
+// POSIXLY_CORRECT is set in the environment.
+func posixMode(args []string) bool {
+	if _, ok := os.LookupEnv("POSIXLY_CORRECT"); ok {
+		return true
+	}
+	for _, a := range args {
+		if a == "--" {
+			break
+		}
+		if a == "--posix" || a == "-posix" {
+			return true
+		}
+	}
+	return false
+}
+
+// posixState is the part of the classic command line with no counterpart
+// among the regular flags.
+type posixState struct {
+	prog    string
+	test    bool
+	quiet   bool
+	license bool
+	help    bool
+	failed  int // exit code so far; the highest one wins
+
+	testFailed bool // -t found a damaged file
+}
+
+// posixFlags is the policy for flag registration in posix mode: the
+// classic bzip2 1.0.8 flags, by short and long name, and what each does.
+// Any other flag is rejected, regular extensions as unsupported.
+var posixFlags = map[string]func(*posixState){
+	"c": func(*posixState) { *stdout = true }, "stdout": func(*posixState) { *stdout = true },
+	"d": func(*posixState) { *decompress = true }, "decompress": func(*posixState) { *decompress = true },
+	"z": func(*posixState) { *decompress = false }, "compress": func(*posixState) { *decompress = false },
+	"k": func(*posixState) { *keep = true }, "keep": func(*posixState) { *keep = true },
+	"f": func(*posixState) { *force = true }, "force": func(*posixState) { *force = true },
+	"t": func(s *posixState) { s.test = true }, "test": func(s *posixState) { s.test = true },
+	"q": func(s *posixState) { s.quiet = true }, "quiet": func(s *posixState) { s.quiet = true },
+	"v": func(*posixState) { *verbose = true }, "verbose": func(*posixState) { *verbose = true },
+	"L": func(s *posixState) { s.license = true }, "license": func(s *posixState) { s.license = true },
+	"V": func(s *posixState) { s.license = true }, "version": func(s *posixState) { s.license = true },
+	"h": func(s *posixState) { s.help = true }, "help": func(s *posixState) { s.help = true },
+	// -s selects the slower low-memory decoder upstream; it changes
+	// nothing observable, so it is accepted and ignored.
+	"s": func(*posixState) {}, "small": func(*posixState) {},
+	"1": func(*posixState) { level = 1 }, "fast": func(*posixState) { level = 1 },
+	"2": func(*posixState) { level = 2 },
+	"3": func(*posixState) { level = 3 },
+	"4": func(*posixState) { level = 4 },
+	"5": func(*posixState) { level = 5 },
+	"6": func(*posixState) { level = 6 },
+	"7": func(*posixState) { level = 7 },
+	"8": func(*posixState) { level = 8 },
+	"9": func(*posixState) { level = 9 }, "best": func(*posixState) { level = 9 },
+	// accepted and ignored upstream as well
+	"repetitive-fast": func(*posixState) {}, "repetitive-best": func(*posixState) {},
+	"exponential": func(*posixState) {},
+	"posix":       func(*posixState) {},
+}
+
+// posixMain runs the command line args the way bzip2 1.0.8 would and
+// returns its exit code. As upstream, flags and file names may come in
+// any order, short flags may be combined (-dkv), flags are also taken
+// from $BZIP2 and $BZIP, and the program name selects the default mode
+// (bunzip2, bzcat).
+func posixMain(args []string) (code int) {
+	s := &posixState{prog: filepath.Base(os.Args[0])}
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "%s: internal error: %v\n", s.prog, r)
+			code = exitInternal
+		}
+	}()
+
+	level = 9
+	*stdinName = "(stdin)"
+	if strings.Contains(s.prog, "unzip") {
+		*decompress = true
+	}
+	catMode := strings.Contains(s.prog, "z2cat") || strings.Contains(s.prog, "zcat")
+	if catMode {
+		*decompress = true
+	}
+
+	env := append(strings.Fields(os.Getenv("BZIP2")), strings.Fields(os.Getenv("BZIP"))...)
+	var files []string
+	flagsDone := false
+	for _, a := range append(env, args...) {
+		switch {
+		case flagsDone || a == "-" || !strings.HasPrefix(a, "-"):
+			files = append(files, a)
+		case a == "--":
+			flagsDone = true
+		case a == "--posix" || a == "-posix":
+		case strings.HasPrefix(a, "--"):
+			name := strings.SplitN(a[2:], "=", 2)[0]
+			set, ok := posixFlags[name]
+			if !ok || len(name) == 1 || strings.Contains(a, "=") {
+				return s.badFlag(a, name)
+			}
+			set(s)
+		default:
+			if len(a) > 2 && flag.Lookup(a[1:]) != nil {
+				return s.badFlag(a, a[1:])
+			}
+			for _, c := range a[1:] {
+				set, ok := posixFlags[string(c)]
+				if !ok {
+					return s.badFlag(a, string(c))
+				}
+				set(s)
+			}
+		}
+	}
+
+	if s.license {
+		fmt.Fprintf(os.Stderr, "bzip2, a block-sorting file compressor.  Go implementation, bzip2 1.0.8 compatible mode.\n\n")
+		return exitOK
+	}
+	if s.help {
+		posixUsage(s.prog)
+		return exitOK
+	}
+
+	for _, f := range files {
+		if len(f) > namePad {
+			namePad = len(f)
+		}
+	}
+	if namePad < len("(stdin)") {
+		namePad = len("(stdin)")
+	}
+
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	if catMode || len(files) == 1 && files[0] == "-" {
+		*stdout = true
+	}
+	if s.test {
+		// -t writes nothing; like -c, it derives no output name
+		*decompress = true
+		*stdout = true
+	}
+	pol = s
+
+	named := 0
+	for _, f := range files {
+		if f != "-" {
+			named++
+		}
+	}
+	for i, f := range files {
+		if fatal := s.file(f); fatal {
+			if left := named - (i + 1); left > 0 && !s.quiet {
+				fmt.Fprintf(os.Stderr, "%s: WARNING: some files have not been processed:\n"+
+					"%s:    %d specified on command line, %d not processed yet.\n\n", s.prog, s.prog, named, left)
+			}
+			return s.failed
+		}
+	}
+	if s.testFailed {
+		if !s.quiet {
+			fmt.Fprintf(os.Stderr, "\nYou can use the `bzip2recover' program to attempt to recover\n"+
+				"data from undamaged sections of corrupted files.\n\n")
+		}
+		s.fail(exitCorrupt)
+	}
+	return s.failed
+}
+
+func (s *posixState) fail(code int) {
+	if code > s.failed {
+		s.failed = code
+	}
+}
+
+// badFlag reports a flag rejected by the posix policy.
+func (s *posixState) badFlag(arg, name string) int {
+	if flag.Lookup(name) != nil && posixFlags[name] == nil {
+		fmt.Fprintf(os.Stderr, "%s: %s: unsupported in posix mode\n", s.prog, arg)
+		return exitEnv
+	}
+	fmt.Fprintf(os.Stderr, "%s: Bad flag `%s'\n", s.prog, arg)
+	posixUsage(s.prog)
+	return exitEnv
+}
+
+func posixUsage(prog string) {
+	fmt.Fprintf(os.Stderr, `bzip2, a block-sorting file compressor.  Go implementation, bzip2 1.0.8 compatible mode.
+
+   usage: %s [flags and input files in any order]
+
+   -h --help           print this message
+   -d --decompress     force decompression
+   -z --compress       force compression
+   -k --keep           keep (don't delete) input files
+   -f --force          overwrite existing output files
+   -t --test           test compressed file integrity
+   -c --stdout         output to standard out
+   -q --quiet          suppress noncritical error messages
+   -v --verbose        be verbose (a 2nd -v gives more)
+   -L --license        display software version & license
+   -V --version        display software version & license
+   -s --small          use less memory (at most 2500k)
+   -1 .. -9            set block size to 100k .. 900k
+   --fast              alias for -1
+   --best              alias for -9
+
+   If invoked as `+"`bzip2'"+`, default action is to compress.
+              as `+"`bunzip2'"+`,  default action is to decompress.
+              as `+"`bzcat'"+`, default action is to decompress to stdout.
+
+   If no file names are given, bzip2 compresses or decompresses
+   from standard input to standard output.  You can combine
+   short flags, so `+"`-v -4'"+` means the same as -v4 or -4v, &c.
+
+`, prog)
+}
+
+// posixSuffixes maps the compressed suffixes upstream recognises to what
+// replaces them on decompression.
+var posixSuffixes = []struct{ z, plain string }{
+	{".bz2", ""}, {".bz", ""}, {".tbz2", ".tar"}, {".tbz", ".tar"},
+}
+
+// strerror renders an error the way perror does: capitalised, without
+// the operation and path os errors carry.
+func strerror(err error) string {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	msg := err.Error()
+	if msg == "" {
+		return msg
+	}
+	return strings.ToUpper(msg[:1]) + msg[1:]
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// posixError is a problem already worded as upstream words it, with the
+// exit code upstream gives it. The message is empty if -q suppresses it.
+type posixError struct {
+	msg  string
+	code int
+}
+
+func (e posixError) Error() string { return e.msg }
+
+func (s *posixState) errorf(code int, format string, a ...interface{}) error {
+	return posixError{fmt.Sprintf("%s: "+format, append([]interface{}{s.prog}, a...)...), code}
+}
+
+// noticef is errorf for messages -q suppresses.
+func (s *posixState) noticef(code int, format string, a ...interface{}) error {
+	if s.quiet {
+		return posixError{"", code}
+	}
+	return s.errorf(code, format, a...)
+}
+
+// checkInput applies upstream's checks on input files: symlinks are only
+// followed with -c, -t or -f, and only regular files are replaced.
+func (s *posixState) checkInput(inName string, fi os.FileInfo) error {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Stat(inName)
+		if err != nil {
+			return s.errorf(exitEnv, "Can't open input file %s: %s.", inName, strerror(err))
+		}
+		if !*stdout && !*force {
+			return s.errorf(exitEnv, "Input file %s is not a normal file.", inName)
+		}
+		fi = target
+	}
+	if fi.IsDir() {
+		return s.errorf(exitEnv, "Input file %s is a directory.", inName)
+	}
+	if !fi.Mode().IsRegular() && !*stdout {
+		return s.errorf(exitEnv, "Input file %s is not a normal file.", inName)
+	}
+	return nil
+}
+
+// outputName derives the output name as upstream does: the suffixes it
+// knows are replaced, and an unknown one on decompression gets .out.
+func (s *posixState) outputName(inName string) (string, error) {
+	if !*decompress {
+		for _, suf := range posixSuffixes {
+			if strings.HasSuffix(inName, suf.z) {
+				return "", s.noticef(exitEnv, "Input file %s already has %s suffix.", inName, suf.z)
+			}
+		}
+		return inName + ".bz2", nil
+	}
+	for _, suf := range posixSuffixes {
+		if strings.HasSuffix(inName, suf.z) && len(inName) > len(suf.z) {
+			return strings.TrimSuffix(inName, suf.z) + suf.plain, nil
+		}
+	}
+	outName := inName + ".out"
+	if !s.quiet {
+		fmt.Fprintf(os.Stderr, "%s: Can't guess original name for %s -- using %s\n", s.prog, inName, outName)
+	}
+	return outName, nil
+}
+
+func (s *posixState) exists(outName string) error {
+	return s.errorf(exitEnv, "Output file %s already exists.", outName)
+}
+
+// started and report split the -v line as upstream does: the name is
+// printed before the file is converted, so errors follow it.
+func (s *posixState) started(name string) {
+	fmt.Fprintf(os.Stderr, "  %s: %s", name, pad(name))
+}
+
+func (s *posixState) report(name string, nIn, nOut int64) {
+	fmt.Fprint(os.Stderr, reportResult(nIn, nOut))
+}
+
+// file handles one command line operand through outputPath and process,
+// with the posix policy in effect. It reports whether the error was one
+// upstream stops the whole run for.
+func (s *posixState) file(inName string) (fatal bool) {
+	stdin = inName == "-"
+	if stdin {
+		inName = ""
+	}
+	shown := inName
+	if stdin {
+		shown = "(stdin)"
+	}
+
+	if stdin && *decompress && isTerminal(os.Stdin) {
+		fmt.Fprintf(os.Stderr, "%s: I won't read compressed data from a terminal.\n", s.prog)
+		fmt.Fprintf(os.Stderr, "%s: For help, type: `%s --help'.\n", s.prog, s.prog)
+		s.fail(exitEnv)
+		return false
+	}
+	if *stdout && !*decompress && isTerminal(os.Stdout) {
+		fmt.Fprintf(os.Stderr, "%s: I won't write compressed data to a terminal.\n", s.prog)
+		fmt.Fprintf(os.Stderr, "%s: For help, type: `%s --help'.\n", s.prog, s.prog)
+		s.fail(exitEnv)
+		return false
+	}
+
+	var outName string
+	var fi os.FileInfo
+	var err error
+	if !stdin {
+		outName, err = outputPath(inName)
+		fi, _ = os.Stat(inName)
+	}
+	if err == nil && s.test {
+		return s.testFile(inName, shown)
+	}
+	if err == nil && *decompress && !stdin && !posixMagic(inName) {
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "  %s: %snot a bzip2 file.\n", inName, pad(inName))
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s is not a bzip2 file.\n", s.prog, inName)
+		}
+		s.fail(exitCorrupt)
+		return false
+	}
+	if err == nil {
+		_, err = process(inName, outName, nil)
+	}
+	if err == nil {
+		if outName != "" && fi != nil {
+			os.Chmod(outName, fi.Mode().Perm())
+			os.Chtimes(outName, fi.ModTime(), fi.ModTime())
+		}
+		return false
+	}
+
+	switch e := err.(type) {
+	case posixError:
+		if e.msg != "" {
+			fmt.Fprintf(os.Stderr, "%s\n", e.msg)
+		}
+		s.fail(e.code)
+		return false
+	case argError:
+		fmt.Fprintf(os.Stderr, "%s: %s.\n", s.prog, e)
+		s.fail(exitEnv)
+		return false
+	case *os.PathError:
+		if e.Path == outName {
+			fmt.Fprintf(os.Stderr, "%s: Can't create output file %s: %s.\n", s.prog, outName, strerror(err))
+			s.fail(exitEnv)
+			return false
+		}
+		if e.Path == inName && e.Op != "read" {
+			what := "input file" // -t says just "input"
+			if s.test {
+				what = "input"
+			}
+			fmt.Fprintf(os.Stderr, "%s: Can't open %s %s: %s.\n", s.prog, what, inName, strerror(err))
+			s.fail(exitEnv)
+			return false
+		}
+	}
+	if outName == "" {
+		outName = "(stdout)"
+	}
+	s.dataError(err, shown, outName)
+	return true
+}
+
+// posixMagic reports whether the file starts with a bzip2 stream header.
+func posixMagic(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return true // let the open error surface later
+	}
+	defer f.Close()
+	var b [4]byte
+	if _, err = io.ReadFull(f, b[:]); err != nil {
+		return false
+	}
+	return bytes.HasPrefix(b[:], []byte("BZh")) && b[3] >= '1' && b[3] <= '9'
+}
+
+// testFile implements -t: decompress into nothing and report. The advice
+// on damaged files is given once, at the end of the run.
+func (s *posixState) testFile(inName, shown string) (fatal bool) {
+	in := os.Stdin
+	if !stdin {
+		var err error
+		if in, err = os.Open(inName); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: Can't open input %s: %s.\n", s.prog, inName, strerror(err))
+			s.fail(exitEnv)
+			return false
+		}
+		defer in.Close()
+	}
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "  %s: %s", shown, pad(shown))
+	}
+	if !stdin && !posixMagic(inName) {
+		if !*verbose {
+			fmt.Fprintf(os.Stderr, "%s: %s: ", s.prog, shown)
+		}
+		fmt.Fprintf(os.Stderr, "bad magic number (file not created by bzip2)\n")
+		s.testFailed = true
+		return false
+	}
+	err := transform(ioutil.Discard, in, &result{})
+	if err == nil {
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "ok\n")
+		}
+		return false
+	}
+	if !*verbose {
+		fmt.Fprintf(os.Stderr, "%s: %s: ", s.prog, shown)
+	}
+	switch {
+	case isCorrupted(err):
+		fmt.Fprintf(os.Stderr, "data integrity (CRC) error in data\n")
+	case err == io.ErrUnexpectedEOF:
+		fmt.Fprintf(os.Stderr, "file ends unexpectedly\n")
+	default:
+		fmt.Fprintf(os.Stderr, "I/O or other error: %s\n", strerror(err))
+		s.fail(exitEnv)
+		return true
+	}
+	s.testFailed = true
+	return false
+}
+
+// isCorrupted reports whether err is the decompressor rejecting its
+// input; the compress package marks such errors with IsCorrupted.
+func isCorrupted(err error) bool {
+	c, ok := err.(interface{ IsCorrupted() bool })
+	return ok && c.IsCorrupted()
+}
+
+// dataError reports a failure that upstream treats as fatal to the run,
+// with the advice -q leaves out, and says the partial output is removed.
+func (s *posixState) dataError(err error, inName, outName string) {
+	names := fmt.Sprintf("\tInput file = %s, output file = %s\n", inName, outName)
+	advice := "\nIt is possible that the compressed file(s) have become corrupted.\n" +
+		"You can use the -tvv option to test integrity of such files.\n\n" +
+		"You can use the `bzip2recover' program to attempt to recover\n" +
+		"data from undamaged sections of corrupted files.\n\n"
+	if s.quiet {
+		names, advice = "", ""
+	}
+	switch {
+	case isCorrupted(err):
+		fmt.Fprintf(os.Stderr, "\n%s: Data integrity error when decompressing.\n%s%s", s.prog, names, advice)
+		s.fail(exitCorrupt)
+	case err == io.ErrUnexpectedEOF:
+		// upstream follows this with perror, which shows whatever errno
+		// its last failed call left behind
+		reason := "No such file or directory"
+		if inName == "(stdin)" {
+			reason = "Inappropriate ioctl for device"
+		} else if outName == "(stdout)" {
+			reason = "Success"
+		}
+		if !s.quiet {
+			fmt.Fprintf(os.Stderr, "\n%s: Compressed file ends unexpectedly;\n\t"+
+				"perhaps it is corrupted?  *Possible* reason follows.\n%s: %s\n%s%s",
+				s.prog, s.prog, reason, names, advice)
+		}
+		s.fail(exitCorrupt)
+	default:
+		fmt.Fprintf(os.Stderr, "\n%s: I/O or other error, bailing out.  Possible reason follows.\n%s: %s\n%s",
+			s.prog, s.prog, strerror(err), names)
+		s.fail(exitEnv)
+	}
+	if outName != "(stdout)" && !s.quiet {
+		fmt.Fprintf(os.Stderr, "%s: Deleting output file %s, if it exists.\n", s.prog, outName)
+	}
+}
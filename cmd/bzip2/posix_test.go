@@ -0,0 +1,270 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+// With -record, TestPosixTranscripts runs the given bzip2 1.0.8 binary
+// instead and rewrites testdata/posix from it:
+//
+//	go test -run PosixTranscripts -record=/usr/bin/bzip2
+var record = flag.String("record", "", "record posix transcripts from this bzip2 `binary`")
+
+// posixCases is the matrix of invocations run in posix mode. Inputs are
+// copied from testdata/posix/input, except "dir", a directory, and
+// "link", a symlink to a. What differs from upstream by design is not
+// run: -L and -V, the per-block detail of -vv, and the extension flags,
+// which are rejected as unsupported (see TestPosixRejectsExtensions).
+var posixCases = []struct {
+	name  string
+	args  []string // program name first
+	files []string
+	env   []string
+	stdin string // input fed on stdin; none if empty
+}{
+	{"compress", []string{"bzip2", "a"}, []string{"a"}, nil, ""},
+	{"compress-keep", []string{"bzip2", "-k", "a"}, []string{"a"}, nil, ""},
+	{"compress-verbose", []string{"bzip2", "-v", "a", "b"}, []string{"a", "b"}, nil, ""},
+	{"compress-empty", []string{"bzip2", "-v", "empty"}, []string{"empty"}, nil, ""},
+	{"flags-after-files", []string{"bzip2", "a", "-kv1"}, []string{"a"}, nil, ""},
+	{"long-flags", []string{"bzip2", "--keep", "--fast", "--verbose", "a"}, []string{"a"}, nil, ""},
+	{"double-dash", []string{"bzip2", "-k", "--", "a"}, []string{"a"}, nil, ""},
+	{"small", []string{"bzip2", "-sk", "a"}, []string{"a"}, nil, ""},
+	{"stdout", []string{"bzip2", "-c", "a"}, []string{"a"}, nil, ""},
+	{"stdin", []string{"bzip2"}, nil, nil, "a"},
+	{"stdin-dash", []string{"bzip2", "-"}, nil, nil, "a"},
+	{"stdin-decompress", []string{"bzip2", "-d"}, nil, nil, "c.bz2"},
+	{"exists", []string{"bzip2", "a"}, []string{"a", "a.bz2"}, nil, ""},
+	{"exists-force", []string{"bzip2", "-f", "a"}, []string{"a", "a.bz2"}, nil, ""},
+	{"has-suffix", []string{"bzip2", "c.bz2", "tarball.tbz"}, []string{"c.bz2", "tarball.tbz"}, nil, ""},
+	{"has-suffix-quiet", []string{"bzip2", "-q", "c.bz2"}, []string{"c.bz2"}, nil, ""},
+	{"missing", []string{"bzip2", "nosuch", "a"}, []string{"a"}, nil, ""},
+	{"directory", []string{"bzip2", "dir"}, []string{"dir"}, nil, ""},
+	{"symlink", []string{"bzip2", "link"}, []string{"a", "link"}, nil, ""},
+	{"symlink-stdout", []string{"bzip2", "-c", "link"}, []string{"a", "link"}, nil, ""},
+	{"symlink-force", []string{"bzip2", "-f", "link"}, []string{"a", "link"}, nil, ""},
+	{"decompress", []string{"bzip2", "-d", "c.bz2"}, []string{"c.bz2"}, nil, ""},
+	{"decompress-verbose", []string{"bzip2", "-dvk", "c.bz2"}, []string{"c.bz2"}, nil, ""},
+	{"decompress-stdout", []string{"bzip2", "-dc", "c.bz2"}, []string{"c.bz2"}, nil, ""},
+	{"decompress-tbz", []string{"bzip2", "-d", "tarball.tbz"}, []string{"tarball.tbz"}, nil, ""},
+	{"decompress-guess", []string{"bzip2", "-d", "data.foo"}, []string{"data.foo"}, nil, ""},
+	{"decompress-not-bzip2", []string{"bzip2", "-d", "notbz.bz2", "c.bz2"}, []string{"notbz.bz2", "c.bz2"}, nil, ""},
+	{"decompress-not-bzip2-quiet", []string{"bzip2", "-dq", "notbz.bz2"}, []string{"notbz.bz2"}, nil, ""},
+	{"decompress-not-bzip2-verbose", []string{"bzip2", "-dv", "notbz.bz2"}, []string{"notbz.bz2"}, nil, ""},
+	{"decompress-corrupt", []string{"bzip2", "-d", "bad.bz2", "c.bz2"}, []string{"bad.bz2", "c.bz2"}, nil, ""},
+	{"decompress-corrupt-quiet", []string{"bzip2", "-dq", "bad.bz2", "c.bz2"}, []string{"bad.bz2", "c.bz2"}, nil, ""},
+	{"decompress-corrupt-verbose", []string{"bzip2", "-dv", "bad.bz2"}, []string{"bad.bz2"}, nil, ""},
+	{"decompress-corrupt-last", []string{"bzip2", "-dk", "c.bz2", "bad.bz2"}, []string{"c.bz2", "bad.bz2"}, nil, ""},
+	{"decompress-truncated", []string{"bzip2", "-d", "trunc.bz2"}, []string{"trunc.bz2"}, nil, ""},
+	{"decompress-truncated-stdout", []string{"bzip2", "-dc", "trunc.bz2"}, []string{"trunc.bz2"}, nil, ""},
+	{"decompress-truncated-stdin", []string{"bzip2", "-d"}, nil, nil, "trunc.bz2"},
+	{"test", []string{"bzip2", "-t", "c.bz2", "bad.bz2", "trunc.bz2", "notbz.bz2"},
+		[]string{"c.bz2", "bad.bz2", "trunc.bz2", "notbz.bz2"}, nil, ""},
+	{"test-verbose", []string{"bzip2", "-tv", "c.bz2", "bad.bz2", "trunc.bz2"},
+		[]string{"c.bz2", "bad.bz2", "trunc.bz2"}, nil, ""},
+	{"test-quiet", []string{"bzip2", "-tq", "bad.bz2"}, []string{"bad.bz2"}, nil, ""},
+	{"test-missing", []string{"bzip2", "-t", "nosuch", "c.bz2"}, []string{"c.bz2"}, nil, ""},
+	{"test-directory", []string{"bzip2", "-t", "dir"}, []string{"dir"}, nil, ""},
+	{"missing-after-exists", []string{"bzip2", "-v", "a", "nosuch"}, []string{"a", "a.bz2"}, nil, ""},
+	{"bunzip2", []string{"bunzip2", "c.bz2"}, []string{"c.bz2"}, nil, ""},
+	{"bzcat", []string{"bzcat", "c.bz2"}, []string{"c.bz2"}, nil, ""},
+	{"env-bzip2", []string{"bzip2", "a"}, []string{"a"}, []string{"BZIP2=-k"}, ""},
+	{"env-bzip", []string{"bzip2", "a"}, []string{"a"}, []string{"BZIP=-kv"}, ""},
+	{"bad-flag", []string{"bzip2", "-x", "a"}, []string{"a"}, nil, ""},
+	{"bad-long-flag", []string{"bzip2", "--frobnicate", "a"}, []string{"a"}, nil, ""},
+	{"help", []string{"bzip2", "--help"}, nil, nil, ""},
+}
+
+// posixNormal masks what legitimately differs from upstream in a
+// transcript: the banner names this implementation, and the compressed
+// sizes, so the ratios, depend on the compressor.
+var posixNormal = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?m)^(bzip2, a block-sorting file compressor\.).*$`), "$1 ..."},
+	{regexp.MustCompile(`(?m)^(  \S.*?:) +[0-9.]+:1, +[0-9.]+ bits/byte, +-?[0-9.]+% saved, (\d+) in, \d+ out\.$`),
+		"$1 R:1, B bits/byte, S% saved, $2 in, N out."},
+}
+
+func TestPosixTranscripts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("transcripts are recorded on unix")
+	}
+	for _, tc := range posixCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			for _, name := range tc.files {
+				placeInput(t, dir, name)
+			}
+
+			var cmd *exec.Cmd
+			if *record != "" {
+				cmd = exec.Command(*record, tc.args[1:]...)
+				cmd.Args[0] = tc.args[0]
+				cmd.Dir = dir
+				cmd.Env = os.Environ()
+			} else {
+				cmd = command(t, dir, tc.args[0], tc.args[1:]...)
+			}
+			cmd.Env = append(posixEnv(cmd.Env), tc.env...)
+			if tc.stdin != "" {
+				in, err := os.Open(filepath.Join("testdata", "posix", "input", tc.stdin))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer in.Close()
+				cmd.Stdin = in
+			}
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			code := 0
+			if err := cmd.Run(); err != nil {
+				ee, ok := err.(*exec.ExitError)
+				if !ok {
+					t.Fatal(err)
+				}
+				code = ee.ExitCode()
+			}
+
+			got := transcript(t, tc.args, tc.env, code, stderr.Bytes(), stdout.Bytes(), dir)
+			file := filepath.Join("testdata", "posix", tc.name+".txt")
+			if *record != "" {
+				if err := ioutil.WriteFile(file, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g, w := normalize(got), normalize(string(want)); g != w {
+				t.Errorf("transcript differs from bzip2 1.0.8\n--- got:\n%s\n--- want:\n%s", g, w)
+			}
+		})
+	}
+}
+
+// posixEnv is env for a transcript run: posix mode on, and no flags from
+// the caller's $BZIP2 or $BZIP.
+func posixEnv(base []string) []string {
+	env := []string{"POSIXLY_CORRECT=1"}
+	for _, kv := range base {
+		if !strings.HasPrefix(kv, "BZIP2=") && !strings.HasPrefix(kv, "BZIP=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+func placeInput(t *testing.T, dir, name string) {
+	var err error
+	switch name {
+	case "dir":
+		err = os.Mkdir(filepath.Join(dir, name), 0755)
+	case "link":
+		err = os.Symlink("a", filepath.Join(dir, name))
+	default:
+		var b []byte
+		b, err = ioutil.ReadFile(filepath.Join("testdata", "posix", "input", name))
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, name), b, 0644)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// transcript renders what a run did: its exit code, stderr, stdout and
+// the files left in dir.
+func transcript(t *testing.T, args, env []string, code int, stderr, stdout []byte, dir string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "$ %s\n", strings.Join(append(append([]string{}, env...), args...), " "))
+	fmt.Fprintf(&b, "exit %d\n", code)
+	fmt.Fprintf(&b, "-- stderr --\n%s", stderr)
+	fmt.Fprintf(&b, "-- stdout --\n%s\n", digest(stdout))
+	fmt.Fprintf(&b, "-- files --\n")
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range infos {
+		name := filepath.Join(dir, fi.Name())
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(name)
+			fmt.Fprintf(&b, "%s -> %s\n", fi.Name(), target)
+		case fi.IsDir():
+			fmt.Fprintf(&b, "%s/\n", fi.Name())
+		default:
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(&b, "%s %04o %s\n", fi.Name(), fi.Mode().Perm(), digest(data))
+		}
+	}
+	return b.String()
+}
+
+// digest identifies content: by its decompressed bytes if it is valid
+// bzip2, as compressed bytes differ between compressors, by its own
+// bytes otherwise.
+func digest(data []byte) string {
+	if bytes.HasPrefix(data, []byte("BZh")) {
+		if z, err := bzip2.NewReader(bytes.NewReader(data), nil); err == nil {
+			plain, err := ioutil.ReadAll(z)
+			z.Close()
+			if err == nil {
+				return fmt.Sprintf("bzip2 of %x", sha256.Sum256(plain))[:len("bzip2 of ")+16]
+			}
+		}
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:16]
+}
+
+func normalize(s string) string {
+	for _, n := range posixNormal {
+		s = n.re.ReplaceAllString(s, n.repl)
+	}
+	return s
+}
+
+func TestPosixRejectsExtensions(t *testing.T) {
+	for _, arg := range []string{"--rename-existing", "-rename-existing", "--cores=2", "-progress"} {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		placeInput(t, dir, "a")
+		cmd := command(t, dir, "bzip2", arg, "a")
+		cmd.Env = append(cmd.Env, "POSIXLY_CORRECT=1")
+		out, err := cmd.CombinedOutput()
+		if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != exitEnv {
+			t.Errorf("%s: got %v, want exit %d", arg, err, exitEnv)
+		}
+		if want := "bzip2: " + arg + ": unsupported in posix mode\n"; string(out) != want {
+			t.Errorf("%s: got %q, want %q", arg, out, want)
+		}
+		if _, err = os.Stat(filepath.Join(dir, "a")); err != nil {
+			t.Errorf("%s: input touched: %v", arg, err)
+		}
+	}
+}
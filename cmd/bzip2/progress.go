@@ -0,0 +1,228 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateWindow is the horizon of the smoothed rate behind the ETA. A lifetime
+// average misleads when speed changes between regions of a file.
+const rateWindow = 30 * time.Second
+
+var (
+	// stderrMu serialises status line redraws with the report lines
+	// printed between them.
+	stderrMu    sync.Mutex
+	statusShown bool
+)
+
+// eprintf prints to stderr, first erasing the status line if one is shown;
+// the next tick redraws it below the message.
+func eprintf(format string, a ...interface{}) {
+	stderrMu.Lock()
+	defer stderrMu.Unlock()
+	clearStatus()
+	fmt.Fprintf(os.Stderr, format, a...)
+}
+
+func clearStatus() {
+	if statusShown {
+		fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", 79))
+		statusShown = false
+	}
+}
+
+// meter counts bytes fed to it as an io.Writer and keeps a smoothed rate
+// of them.
+type meter struct {
+	done int64 // accessed atomically; first for 64-bit alignment
+
+	name  string
+	total int64 // -1 if unknown
+
+	rate  float64 // exponentially weighted bytes/s
+	last  int64
+	lastT time.Time
+}
+
+func (m *meter) Write(b []byte) (int, error) {
+	atomic.AddInt64(&m.done, int64(len(b)))
+	return len(b), nil
+}
+
+// sample folds the rate since the previous tick into the moving average,
+// weighting it by how much of rateWindow the tick covers.
+func (m *meter) sample(now time.Time) {
+	dt := now.Sub(m.lastT).Seconds()
+	if dt <= 0 {
+		return
+	}
+	done := atomic.LoadInt64(&m.done)
+	r := float64(done-m.last) / dt
+	if m.last == 0 && m.rate == 0 {
+		m.rate = r
+	} else {
+		alpha := 1 - math.Exp(-dt/rateWindow.Seconds())
+		m.rate += alpha * (r - m.rate)
+	}
+	m.last, m.lastT = done, now
+}
+
+// percent formats how much is done: a percentage of the total if known,
+// the byte count otherwise.
+func (m *meter) percent(done int64) string {
+	if m.total > 0 {
+		return fmt.Sprintf("%5.1f%%", 100*float64(done)/float64(m.total))
+	}
+	return humanBytes(float64(done))
+}
+
+// eta formats the time left as hh:mm:ss, or "--:--" when the size is
+// unknown or the rate is effectively zero.
+func (m *meter) eta(done int64) string {
+	if m.total < 0 || m.rate < 1 {
+		return "--:--"
+	}
+	left := m.total - done
+	if left < 0 {
+		left = 0
+	}
+	s := int64(float64(left) / m.rate)
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+// progress draws a one-line status on stderr while a run is processed:
+// percent done, smoothed rate and ETA. Input bytes are fed to it as an
+// io.Writer, typically through io.TeeReader. In multi-file runs input
+// is fed through per-file meters instead, and the file started first of
+// those in flight is shown with its own ETA alongside the run's.
+type progress struct {
+	meter
+
+	mu    sync.Mutex // guards name, total and files
+	files []*fileMeter
+
+	stop chan struct{}
+	exit chan struct{}
+}
+
+// fileMeter is the meter of one file of a run; its bytes count towards
+// the run as well.
+type fileMeter struct {
+	meter
+	run *progress
+}
+
+func (f *fileMeter) Write(b []byte) (int, error) {
+	atomic.AddInt64(&f.done, int64(len(b)))
+	return f.run.Write(b)
+}
+
+func newProgress(name string, total int64) *progress {
+	p := &progress{
+		meter: meter{name: name, total: total, lastT: time.Now()},
+		stop:  make(chan struct{}),
+		exit:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// startFile returns the meter for a file of total bytes (-1 if unknown)
+// about to be processed.
+func (p *progress) startFile(name string, total int64) *fileMeter {
+	f := &fileMeter{meter: meter{name: name, total: total, lastT: time.Now()}, run: p}
+	p.mu.Lock()
+	p.files = append(p.files, f)
+	p.mu.Unlock()
+	return f
+}
+
+// endFile stops showing f.
+func (p *progress) endFile(f *fileMeter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.files {
+		if p.files[i] == f {
+			p.files = append(p.files[:i], p.files[i+1:]...)
+			break
+		}
+	}
+}
+
+func (p *progress) run() {
+	defer close(p.exit)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			p.draw(now)
+		case <-p.stop:
+			stderrMu.Lock()
+			clearStatus()
+			stderrMu.Unlock()
+			return
+		}
+	}
+}
+
+// set replaces the label and the expected total, as for a run whose
+// size becomes known once its file list is complete.
+func (p *progress) set(name string, total int64) {
+	p.mu.Lock()
+	p.name, p.total = name, total
+	p.mu.Unlock()
+}
+
+func (p *progress) draw(now time.Time) {
+	p.mu.Lock()
+	p.sample(now)
+	done := atomic.LoadInt64(&p.done)
+	line := fmt.Sprintf("  %s: %s  %s/s  ETA %s", p.name, p.percent(done), humanBytes(p.rate), p.eta(done))
+	for _, f := range p.files {
+		f.sample(now)
+	}
+	if len(p.files) > 0 {
+		f := p.files[0]
+		done := atomic.LoadInt64(&f.done)
+		line += fmt.Sprintf("  %s: %s  ETA %s", filepath.Base(f.name), f.percent(done), f.eta(done))
+	}
+	p.mu.Unlock()
+	if len(line) > 79 {
+		line = line[:79]
+	}
+	stderrMu.Lock()
+	fmt.Fprintf(os.Stderr, "\r%-79s", line)
+	statusShown = true
+	stderrMu.Unlock()
+}
+
+// Close stops the display and erases its line.
+func (p *progress) Close() error {
+	close(p.stop)
+	<-p.exit
+	return nil
+}
+
+func humanBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	div, exp := float64(unit), 0
+	for n/div >= unit && exp < 5 {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", n/div, "KMGTPE"[exp])
+}
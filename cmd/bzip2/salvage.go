@@ -0,0 +1,236 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+// The 48-bit magic numbers that start a block and end a stream. Blocks
+// are bit-packed, so they are only found by scanning bit by bit.
+const (
+	blockMagic = 0x314159265359
+	eosMagic   = 0x177245385090
+	magicMask  = 1<<48 - 1
+)
+
+// incompleteError reports that decompression finished but had to skip
+// damaged data; the output exists but is missing parts.
+type incompleteError string
+
+func (e incompleteError) Error() string { return string(e) }
+
+// bitBuffer is an append-only sequence of bits, most significant first.
+type bitBuffer struct {
+	buf   []byte
+	nbits int
+}
+
+func (b *bitBuffer) writeBit(bit uint) {
+	if b.nbits%8 == 0 {
+		b.buf = append(b.buf, 0)
+	}
+	b.buf[b.nbits/8] |= byte(bit) << uint(7-b.nbits%8)
+	b.nbits++
+}
+
+func (b *bitBuffer) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		b.writeBit(uint(v>>uint(i)) & 1)
+	}
+}
+
+func (b *bitBuffer) bit(i int) uint {
+	return uint(b.buf[i/8]>>uint(7-i%8)) & 1
+}
+
+// truncate drops the last n bits.
+func (b *bitBuffer) truncate(n int) {
+	b.nbits -= n
+	b.buf = b.buf[:(b.nbits+7)/8]
+	if r := b.nbits % 8; r != 0 {
+		b.buf[len(b.buf)-1] &= byte(0xff << uint(8-r))
+	}
+}
+
+func (b *bitBuffer) reset() {
+	b.buf = b.buf[:0]
+	b.nbits = 0
+}
+
+// salvageReader decompresses a bzip2 archive block by block for
+// --salvage. Each block found in the input is wrapped into a stream of
+// its own and decoded separately, so a block that fails to decode is
+// skipped, replaced by the marker, and decoding resumes at the next
+// block magic.
+type salvageReader struct {
+	in     *bufio.Reader
+	marker []byte
+
+	shift      uint64 // last bits read
+	nread      int    // bits read, up to 48
+	collecting bool   // inside a block
+	found      bool   // any magic seen
+	blk        bitBuffer
+	eof        bool
+
+	out     bytes.Buffer // decoded data not yet returned
+	gap     bool         // the previous block was skipped
+	skipped int
+	goodIn  int64 // compressed bytes of decoded blocks
+	goodOut int64
+	badIn   int64 // compressed bytes of skipped blocks
+}
+
+func newSalvageReader(r io.Reader, marker string) *salvageReader {
+	return &salvageReader{in: bufio.NewReader(r), marker: []byte(marker)}
+}
+
+func (s *salvageReader) Read(p []byte) (int, error) {
+	for s.out.Len() == 0 {
+		if s.eof && !s.found {
+			return 0, errors.New("bzip2 data invalid: no blocks found")
+		}
+		if s.eof {
+			return 0, io.EOF
+		}
+		if err := s.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+	return s.out.Read(p)
+}
+
+// nextBlock scans to the end of the next block and decodes it into out.
+func (s *salvageReader) nextBlock() error {
+	for {
+		c, err := s.in.ReadByte()
+		if err == io.EOF {
+			s.eof = true
+			if s.collecting && s.blk.nbits > 0 {
+				// a truncated last block; it will fail to decode
+				s.collecting = false
+				s.decode()
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i := 7; i >= 0; i-- {
+			bit := uint(c>>uint(i)) & 1
+			s.shift = s.shift<<1 | uint64(bit)
+			if s.nread < 48 {
+				s.nread++
+			}
+			if s.collecting {
+				s.blk.writeBit(bit)
+			}
+			if s.nread < 48 {
+				continue
+			}
+			switch s.shift & magicMask {
+			case blockMagic:
+				s.found = true
+				done := s.collecting
+				if done {
+					s.blk.truncate(48)
+					s.decode()
+				}
+				s.collecting = true
+				s.blk.reset()
+				s.blk.writeBits(blockMagic, 48)
+				if done {
+					s.finishByte(c, i)
+					return nil
+				}
+			case eosMagic:
+				s.found = true
+				if s.collecting {
+					s.blk.truncate(48)
+					s.decode()
+					s.collecting = false
+					s.finishByte(c, i)
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// finishByte consumes the bits of c after bit i, as nextBlock returns in
+// the middle of a byte. A block is far longer than a byte, so they can't
+// complete another magic.
+func (s *salvageReader) finishByte(c byte, i int) {
+	for i--; i >= 0; i-- {
+		bit := uint(c>>uint(i)) & 1
+		s.shift = s.shift<<1 | uint64(bit)
+		if s.collecting {
+			s.blk.writeBit(bit)
+		}
+	}
+}
+
+// decode wraps the collected block, magic included, into a stream of its
+// own and decompresses it. The stream CRC of a one-block stream is the
+// block CRC, which follows the magic.
+func (s *salvageReader) decode() {
+	var st bitBuffer
+	for _, c := range []byte("BZh9") {
+		st.writeBits(uint64(c), 8)
+	}
+	for i := 0; i < s.blk.nbits; i++ {
+		st.writeBit(s.blk.bit(i))
+	}
+	st.writeBits(eosMagic, 48)
+	for i := 48; i < 80 && i < s.blk.nbits; i++ {
+		st.writeBit(s.blk.bit(i))
+	}
+
+	size := int64(s.blk.nbits / 8)
+	z, err := bzip2.NewReader(bytes.NewReader(st.buf), nil)
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadAll(z)
+		z.Close()
+	}
+	if err != nil {
+		s.skipped++
+		s.badIn += size
+		if !s.gap {
+			s.out.Write(s.marker)
+		}
+		s.gap = true
+		return
+	}
+	s.gap = false
+	s.goodIn += size
+	s.goodOut += int64(len(data))
+	s.out.Write(data)
+}
+
+// lost estimates the decompressed bytes in the skipped blocks, from the
+// ratio of the blocks that did decode.
+func (s *salvageReader) lost() int64 {
+	if s.skipped == 0 {
+		return 0
+	}
+	if s.goodIn == 0 {
+		return int64(s.skipped) * 900000 // at most a full block each
+	}
+	return s.badIn * s.goodOut / s.goodIn
+}
+
+// salvageError describes what --salvage had to skip in a file.
+func salvageError(res result) error {
+	return incompleteError(fmt.Sprintf("salvage skipped %d damaged block(s), about %d bytes lost",
+		res.skipped, res.lost))
+}
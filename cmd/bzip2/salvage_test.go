@@ -0,0 +1,223 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+const testMarker = "<<GAP>>"
+
+// letters returns n random lowercase letters; they never contain the
+// marker and compress evenly, so lost() has a fair ratio to go by.
+func letters(seed int64, n int) []byte {
+	r := rand.New(rand.NewSource(seed))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('a' + r.Intn(26))
+	}
+	return b
+}
+
+// compress1 compresses data with 100k blocks, to get many blocks from
+// little data.
+func compress1(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	z, err := bzip2.NewWriter(&buf, &bzip2.WriterConfig{Level: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = z.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// magics returns the bit offsets of the block magics in b, and that of the
+// end of stream magic of the last stream.
+func magics(b []byte) (blocks []int, eos int) {
+	var shift uint64
+	for i := 0; i < len(b)*8; i++ {
+		shift = shift<<1 | uint64(b[i/8]>>uint(7-i%8)&1)
+		if i < 47 {
+			continue
+		}
+		switch shift & magicMask {
+		case blockMagic:
+			blocks = append(blocks, i-47)
+		case eosMagic:
+			eos = i - 47
+		}
+	}
+	return blocks, eos
+}
+
+// damage flips a byte halfway between the bit offsets start and end.
+func damage(b []byte, start, end int) {
+	b[(start+end)/16] ^= 0x55
+}
+
+func salvageAll(t *testing.T, archive []byte) (string, *salvageReader) {
+	s := newSalvageReader(bytes.NewReader(archive), testMarker)
+	out, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), s
+}
+
+// checkPieces checks that out is pieces of data in order, separated by
+// one marker per gap; only a gap at either end leaves an empty piece.
+func checkPieces(t *testing.T, out string, data []byte, gaps int) {
+	pieces := strings.Split(out, testMarker)
+	if len(pieces)-1 != gaps {
+		t.Fatalf("%d markers, want %d", len(pieces)-1, gaps)
+	}
+	rest := string(data)
+	for i, p := range pieces {
+		if p == "" && i != 0 && i != len(pieces)-1 {
+			t.Errorf("piece %d is empty", i)
+		}
+		j := strings.Index(rest, p)
+		if j < 0 || i == 0 && j != 0 {
+			t.Fatalf("piece %d (%d bytes) not found in order", i, len(p))
+		}
+		rest = rest[j+len(p):]
+	}
+}
+
+func TestSalvage(t *testing.T) {
+	data := letters(1, 520000)
+	clean := compress1(t, data)
+	blocks, eos := magics(clean)
+	if len(blocks) < 5 {
+		t.Fatalf("%d blocks, want at least 5", len(blocks))
+	}
+	end := func(i int) int {
+		if i+1 < len(blocks) {
+			return blocks[i+1]
+		}
+		return eos
+	}
+
+	for _, tc := range []struct {
+		name    string
+		damaged []int // blocks
+		gaps    int
+	}{
+		{"intact", nil, 0},
+		{"middle block", []int{2}, 1},
+		{"adjacent blocks", []int{2, 3}, 1},
+		{"separate blocks", []int{1, 3}, 2},
+		{"first block", []int{0}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			archive := append([]byte(nil), clean...)
+			for _, i := range tc.damaged {
+				damage(archive, blocks[i], end(i))
+			}
+			out, s := salvageAll(t, archive)
+			checkPieces(t, out, data, tc.gaps)
+			if s.skipped != len(tc.damaged) {
+				t.Errorf("skipped %d, want %d", s.skipped, len(tc.damaged))
+			}
+			if tc.damaged == nil {
+				if out != string(data) {
+					t.Error("intact archive not decoded as is")
+				}
+				return
+			}
+			if !strings.HasSuffix(out, string(data[len(data)-1000:])) {
+				t.Error("tail not recovered")
+			}
+			// the blocks compress alike, so the estimate is close
+			missing := int64(len(data) - len(out) + tc.gaps*len(testMarker))
+			if l := s.lost(); l < missing*9/10 || l > missing*11/10 {
+				t.Errorf("lost() = %d, %d bytes missing", l, missing)
+			}
+		})
+	}
+
+	t.Run("truncated last block", func(t *testing.T) {
+		last := blocks[len(blocks)-1]
+		out, s := salvageAll(t, clean[:(last+eos)/16])
+		if !strings.HasSuffix(out, testMarker) {
+			t.Error("no marker at the end")
+		}
+		checkPieces(t, out, data, 1)
+		if s.skipped != 1 {
+			t.Errorf("skipped %d, want 1", s.skipped)
+		}
+	})
+}
+
+func TestSalvageMultistream(t *testing.T) {
+	data1, data2 := letters(1, 250000), letters(2, 250000)
+	first := compress1(t, data1)
+	blocks, _ := magics(first)
+	if len(blocks) < 3 {
+		t.Fatalf("%d blocks, want at least 3", len(blocks))
+	}
+	damage(first, blocks[1], blocks[2])
+	archive := append(first, compress1(t, data2)...)
+
+	out, s := salvageAll(t, archive)
+	all := append(append([]byte(nil), data1...), data2...)
+	checkPieces(t, out, all, 1)
+	if s.skipped != 1 {
+		t.Errorf("skipped %d, want 1", s.skipped)
+	}
+	if !strings.HasSuffix(out, string(data1[len(data1)-1000:])+string(data2)) {
+		t.Error("rest of the first stream and the second stream not recovered")
+	}
+}
+
+// Through the command, a salvaged file exits 2, keeps its input and says
+// on the -v line what was skipped.
+func TestSalvageCommand(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	data := letters(1, 350000)
+	archive := compress1(t, data)
+	blocks, _ := magics(archive)
+	damage(archive, blocks[1], blocks[2])
+	in := filepath.Join(dir, "f.bz2")
+	if err := ioutil.WriteFile(in, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := command(t, dir, "bzip2", "-d", "-v", "-salvage", "-salvage-marker="+testMarker, "f.bz2")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != exitCorrupt {
+		t.Errorf("got %v, want exit status %d", err, exitCorrupt)
+	}
+	if !strings.Contains(stderr.String(), "f.bz2: incomplete, 1 damaged block(s) skipped\n") {
+		t.Errorf("-v line doesn't report the skipped block:\n%s", &stderr)
+	}
+	if !strings.Contains(stderr.String(), "salvage skipped 1 damaged block(s)") {
+		t.Errorf("no incomplete error:\n%s", &stderr)
+	}
+	if _, err = os.Stat(in); err != nil {
+		t.Errorf("input not kept: %v", err)
+	}
+	out, err := ioutil.ReadFile(filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPieces(t, string(out), data, 1)
+}
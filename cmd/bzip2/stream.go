@@ -0,0 +1,125 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+// sizeFlag is a byte count given as a number with an optional binary
+// suffix: k, M or G.
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	if s == nil || *s == 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeFlag) Set(v string) error {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(v, "k"), strings.HasSuffix(v, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)/mult {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	*s = sizeFlag(n * mult)
+	return nil
+}
+
+// streamWriter compresses into w, finishing the bzip2 stream and starting
+// a fresh one after every `every` bytes of input; 0 means a single
+// stream. As streams share no state, an input region that is unchanged
+// between runs and starts at a stream boundary compresses to the same
+// bytes. Boundaries sit at fixed input offsets, so that only holds after
+// changes that keep the length the same; an insertion or deletion shifts
+// every later stream. Readers see an ordinary multistream archive.
+type streamWriter struct {
+	w     io.Writer
+	every int64
+
+	z       *bzip2.Writer
+	n       int64 // input bytes in the current stream
+	streams int
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if s.z == nil {
+			if err := s.start(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p
+		if s.every > 0 && int64(len(chunk)) > s.every-s.n {
+			chunk = chunk[:s.every-s.n]
+		}
+		n, err := s.z.Write(chunk)
+		written += n
+		s.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if s.every > 0 && s.n == s.every {
+			err = s.z.Close()
+			s.z = nil
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (s *streamWriter) start() (err error) {
+	var conf *bzip2.WriterConfig
+	if level != 0 {
+		conf = &bzip2.WriterConfig{Level: level}
+	}
+	s.z, err = bzip2.NewWriter(s.w, conf)
+	s.n = 0
+	s.streams++
+	return err
+}
+
+// Close finishes the last stream. Empty input still yields one stream.
+func (s *streamWriter) Close() error {
+	if s.z == nil && s.streams == 0 {
+		if err := s.start(); err != nil {
+			return err
+		}
+	}
+	if s.z == nil {
+		return nil
+	}
+	err := s.z.Close()
+	s.z = nil
+	return err
+}
+
+// countingWriter counts and discards what is written to it.
+type countingWriter struct{ n int64 }
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2021, Pedro Albanese. All rights reserved.
+// Use of this source code is governed by a ISC license that
+// can be found in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	stdbzip2 "compress/bzip2"
+	"io/ioutil"
+	"testing"
+)
+
+func streamCompress(t *testing.T, data []byte, every int64) ([]byte, int) {
+	var buf bytes.Buffer
+	z := &streamWriter{w: &buf, every: every}
+	// odd-sized writes, so that stream boundaries fall inside them
+	for p := data; len(p) > 0; {
+		n := 7777
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := z.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), z.streams
+}
+
+// A change that keeps the length leaves every stream after the one it is
+// in byte-identical.
+func TestStreamEverySameLengthChange(t *testing.T) {
+	const every = 64 << 10
+	a := letters(1, 5*every+123)
+	b := append([]byte(nil), a...)
+	b[10] ^= 1
+
+	za, streams := streamCompress(t, a, every)
+	zb, _ := streamCompress(t, b, every)
+	if streams != 6 {
+		t.Errorf("%d streams, want 6", streams)
+	}
+	first, _ := streamCompress(t, a[:every], 0)
+	later := len(za) - len(first)
+
+	common := 0
+	for common < len(za) && common < len(zb) && za[len(za)-1-common] == zb[len(zb)-1-common] {
+		common++
+	}
+	if common < later {
+		t.Errorf("outputs share %d trailing bytes, want at least the %d of the later streams", common, later)
+	}
+
+	for _, tc := range []struct {
+		z, want []byte
+	}{{za, a}, {zb, b}} {
+		got, err := ioutil.ReadAll(stdbzip2.NewReader(bytes.NewReader(tc.z)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Error("output doesn't decompress to the input")
+		}
+	}
+}
+
+func TestStreamEveryEmpty(t *testing.T) {
+	z, streams := streamCompress(t, nil, 1024)
+	if streams != 1 {
+		t.Errorf("%d streams for empty input, want 1", streams)
+	}
+	got, err := ioutil.ReadAll(stdbzip2.NewReader(bytes.NewReader(z)))
+	if err != nil || len(got) != 0 {
+		t.Errorf("got %q, %v", got, err)
+	}
+}